@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/snapshot"
+)
+
+func backup() error {
+	if len(args) < 2 || arg(1) == "" {
+		names := make([]string, 0, len(config.Profiles))
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("expecting profile name, but config has no profiles")
+		}
+		return fmt.Errorf("expecting profile name: %s", strings.Join(names, ", "))
+	}
+	p := config.Profiles[arg(1)]
+	if p == nil {
+		return fmt.Errorf("unknown profile %s", arg(1))
+	}
+	return runProfile(p)
+}
+
+// runProfile runs backup job described by profile: creates snapshot
+// of its sources with hooks, and, if it was created, applies retention
+// policy. Current configuration is restored on return.
+func runProfile(p *config.Profile) error {
+	cur := config.Current()
+	defer cur.Use()
+	if err := p.Use(); err != nil {
+		return err
+	}
+	info := &snapshot.Info{
+		Comment:  p.Comment,
+		Tags:     append(append([]string(nil), p.Tags...), p.Name),
+		Hostname: *hostFlag,
+		Username: *userFlag,
+		Version:  version,
+	}
+	hookEnv = map[string]string{"HESFIC_PROFILE": p.Name}
+	err := withHooks("create", func() error {
+		return withLock(false, func() error { return createFrom(p.Sources, info) })
+	})
+	if exitStatus(err) == 1 || p.Keep == nil {
+		return err
+	}
+	if ferr := withLock(true, func() error { return applyRetention(p) }); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// applyRetention removes snapshots of profile, which are
+// not kept by its retention policy, and collects garbage.
+func applyRetention(p *config.Profile) error {
+	within, _ := config.ParseDuration(p.Keep.Within) // validated on load
+	policy := &snapshot.Policy{
+		Last:    p.Keep.Last,
+		Hourly:  p.Keep.Hourly,
+		Daily:   p.Keep.Daily,
+		Weekly:  p.Keep.Weekly,
+		Monthly: p.Keep.Monthly,
+		Yearly:  p.Keep.Yearly,
+		Within:  within,
+		Tags:    p.Keep.Tags,
+	}
+	all, err := snapshot.GetNames()
+	if err != nil {
+		return err
+	}
+	names, err := snapshot.FilterNames(all, &snapshot.Filter{Tags: []string{p.Name}})
+	if err != nil {
+		return err
+	}
+	decisions, namesToLeave, err := snapshot.Forget(names, policy, *dryRunFlag)
+	if err != nil {
+		return err
+	}
+	garbage, err := collectGarbage(namesToLeave)
+	if err != nil {
+		return err
+	}
+	return printDecisions(decisions, garbage)
+}
@@ -3,9 +3,12 @@ package block
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 
@@ -14,6 +17,8 @@ import (
 	"github.com/dchest/blake2b"
 
 	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/progress"
+	"github.com/dchest/hesfic/safefile"
 )
 
 // Block kinds.
@@ -36,6 +41,28 @@ var (
 	PadSize = 512
 )
 
+// Problems with blocks on disk.
+var (
+	ErrMissing       = errors.New("missing")
+	ErrTruncated     = errors.New("truncated")
+	ErrUndecryptable = errors.New("cannot be decrypted")
+	ErrMismatch      = errors.New("content doesn't match ref")
+)
+
+// BlockError describes a problem with block on disk.
+type BlockError struct {
+	Ref *Ref
+	Err error // ErrMissing, ErrTruncated, ErrUndecryptable or ErrMismatch
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %s: %s", e.Ref, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
 func init() {
 	if PadSize == 0 {
 		panic("PadSize is zero")
@@ -56,12 +83,18 @@ func readNonce(nonce *[24]byte, p []byte) error {
 }
 
 type Writer struct {
-	h          hash.Hash // hash for refs
-	buf        []byte    // buffer for data
-	n          int       // number of data bytes in buffer
-	refs       []*Ref    // list of block refs
-	kind       uint8     // kind of current blocks
-	blockCount int       // number of blocks
+	h          hash.Hash    // hash for refs
+	buf        []byte       // buffer for data
+	n          int          // number of data bytes in buffer
+	refs       []*Ref       // list of block refs
+	kind       uint8        // kind of current blocks
+	blockCount int          // number of blocks
+	newBytes   int64        // number of bytes in newly stored blocks
+	hashOnly   bool         // calculate refs without storing blocks
+	repair     map[Ref]bool // if not nil, store only blocks with these refs
+	repaired   []*Ref       // refs of blocks stored when repairing
+
+	newBlocks map[Ref]int64 // sizes of newly stored blocks
 
 	box   []byte // temporary buffer for encrypted data
 	cdata []byte // temporary buffer for compressed data
@@ -99,10 +132,42 @@ func NewWriter() *Writer {
 	return w
 }
 
+// NewRefWriter returns a new writer, which calculates refs the same way
+// as the writer returned by NewWriter, but doesn't store blocks.
+func NewRefWriter() *Writer {
+	w := NewWriter()
+	w.hashOnly = true
+	return w
+}
+
+// ComputeRef returns ref of content read from r without storing it.
+func ComputeRef(r io.Reader) (*Ref, error) {
+	w := NewRefWriter()
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	return w.Finish()
+}
+
+// Repair reads content from r, splits it into blocks the same way as
+// Writer does, and replaces blocks on disk whose refs are in damaged.
+// It returns ref of the content and refs of replaced blocks.
+func Repair(r io.Reader, damaged map[Ref]bool) (ref *Ref, repaired []*Ref, err error) {
+	w := NewWriter()
+	w.repair = damaged
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, nil, err
+	}
+	ref, err = w.Finish()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ref, w.repaired, nil
+}
+
 func (w *Writer) Write(b []byte) (nn int, err error) {
 	nn = len(b)
-	left := config.BlockSize - w.n
-	if len(b) >= left {
+	for left := config.BlockSize - w.n; len(b) >= left; left = config.BlockSize - w.n {
 		w.n += copy(w.buf[w.n:], b[:left])
 		b = b[left:]
 		if err := w.saveBlock(); err != nil {
@@ -156,12 +221,39 @@ func (w *Writer) BlockCount() int {
 	return w.blockCount
 }
 
+// NewBytes returns the number of bytes in blocks newly stored on disk,
+// that is, excluding blocks that were already stored.
+func (w *Writer) NewBytes() int64 {
+	return w.newBytes
+}
+
+// NewBlocks returns refs and sizes of blocks newly stored on disk.
+func (w *Writer) NewBlocks() map[Ref]int64 {
+	return w.newBlocks
+}
+
 func (w *Writer) saveBlock() error {
 	// Calculate hash of uncompressed data for ref.
 	ref := calculateRef(w.h, w.buf[:w.n])
 
-	//TODO check if this block exists on disk.
-	if blockExistsOnDisk(ref) {
+	store, replace := !w.hashOnly, false
+	if w.repair != nil {
+		// Store only damaged blocks.
+		store = w.repair[*ref]
+		replace = store
+	} else if store && blockExistsOnDisk(ref) {
+		store = false
+		if config.VerifyExistingBlocks {
+			if err := Check(ref); err != nil {
+				log.Printf("replacing bad block: %s", err)
+				store, replace = true, true
+			}
+		}
+	}
+	if !w.hashOnly && w.repair == nil {
+		progress.AddBlock(w.n, store)
+	}
+	if !store {
 		// Append ref to list.
 		w.refs = append(w.refs, ref)
 		w.n = 0
@@ -204,9 +296,26 @@ func (w *Writer) saveBlock() error {
 	copy(fullBox, nonce[:])
 	secretbox.Seal(fullBox[len(nonce):len(nonce)], plainBlock, &nonce, &config.Keys.BlockEnc)
 	// Save to disk.
-	if err := writeBlockToDisk(ref, fullBox); err != nil {
+	if err := writeBlockToDisk(ref, fullBox, replace); err != nil {
 		return err
 	}
+	if w.repair != nil {
+		w.repaired = append(w.repaired, ref)
+	}
+	if replace {
+		// Block has a new nonce, so parity of the old one is stale.
+		err = replaceInParity(ref, fullBox)
+	} else {
+		err = addToParity(ref, fullBox)
+	}
+	if err != nil {
+		return err
+	}
+	w.newBytes += int64(len(fullBox))
+	if w.newBlocks == nil {
+		w.newBlocks = make(map[Ref]int64)
+	}
+	w.newBlocks[*ref] = int64(len(fullBox))
 	// Append ref to list.
 	w.refs = append(w.refs, ref)
 	w.n = 0
@@ -242,45 +351,126 @@ func blockPath(ref *Ref) string {
 	return filepath.Join(config.BlocksPath, name[:2], name[2:])
 }
 
-func writeBlockToDisk(ref *Ref, block []byte) error {
+// writeBlockToDisk atomically writes block to disk, replacing existing
+// block if replace is true.
+func writeBlockToDisk(ref *Ref, block []byte, replace bool) error {
 	path := blockPath(ref)
+	if !replace && blockExistsOnDisk(ref) {
+		// Cool, we already have this block.
+		return nil
+	}
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0444)
+	return writeFile(path, block, 0444)
+}
+
+// writeFile atomically writes file. Tests replace it
+// to simulate a crash in the middle of writing.
+var writeFile = safefile.WriteFile
+
+func isValidBoxSize(size int64) bool {
+	return size >= int64(minBoxSize) && size%int64(PadSize) == 0
+}
+
+// blockExistsOnDisk returns true if block file exists and
+// has the size of a correctly written block.
+func blockExistsOnDisk(ref *Ref) bool {
+	fi, err := os.Stat(blockPath(ref))
 	if err != nil {
-		if os.IsExist(err) {
-			// Cool, we already have this block.
-			// TODO validate that this block is correct?
-			return nil
+		return false
+	}
+	return fi.Mode().IsRegular() && isValidBoxSize(fi.Size())
+}
+
+// Check verifies that block on disk can be decrypted and its content
+// matches ref. Problems with block are reported as *BlockError.
+func Check(ref *Ref) error {
+	r := newBlockReader(ref)
+	return r.readBlock(ref)
+}
+
+// Exists returns true if block with the given ref is stored on disk.
+func Exists(ref *Ref) bool {
+	return blockExistsOnDisk(ref)
+}
+
+// ReadRaw returns encrypted block with the given ref as stored on disk
+// after verifying it. Damaged blocks are reconstructed from parity.
+func ReadRaw(ref *Ref) ([]byte, error) {
+	r := newBlockReader(ref)
+	box, err := ioutil.ReadFile(blockPath(ref))
+	if err == nil {
+		if err = r.openBox(ref, box); err == nil {
+			return box, nil
 		}
-		return err
+	} else if os.IsNotExist(err) {
+		err = &BlockError{ref, ErrMissing}
 	}
-	if _, err := f.Write(block); err != nil {
-		f.Close()
-		os.Remove(path)
-		return err
+	if _, ok := err.(*BlockError); !ok {
+		return nil, err
 	}
-	if config.FileSync {
-		if err := f.Sync(); err != nil {
-			f.Close()
-			os.Remove(path)
-			return err
-		}
+	box, perr := reconstructBox(ref)
+	if perr != nil {
+		return nil, err
+	}
+	if err := r.openBox(ref, box); err != nil {
+		return nil, err
+	}
+	return box, nil
+}
+
+// WriteRaw stores encrypted block with the given ref,
+// unless it already exists on disk.
+func WriteRaw(ref *Ref, box []byte) error {
+	if blockExistsOnDisk(ref) {
+		return nil
 	}
-	if err := f.Close(); err != nil {
-		os.Remove(path)
+	if err := writeBlockToDisk(ref, box, false); err != nil {
 		return err
 	}
-	return nil
+	return addToParity(ref, box)
 }
 
-func blockExistsOnDisk(ref *Ref) bool {
-	//TODO verify that the block on disk is correct?
-	if _, err := os.Stat(blockPath(ref)); err != nil {
-		return false
+// BlockInfo contains sizes of stored block.
+type BlockInfo struct {
+	Size           int // size of uncompressed data
+	CompressedSize int // size of compressed data
+	StoredSize     int // size of block on disk, including padding
+}
+
+// PaddingSize returns the number of padding bytes in stored block.
+func (bi *BlockInfo) PaddingSize() int {
+	return bi.StoredSize - nonceSize - secretbox.Overhead - headerSize - bi.CompressedSize
+}
+
+// Stat reads block with the given ref and returns its sizes.
+func Stat(ref *Ref) (*BlockInfo, error) {
+	r := newBlockReader(ref)
+	if err := r.loadBlock(); err != nil {
+		return nil, err
 	}
-	return true
+	return &BlockInfo{
+		Size:           len(r.block),
+		CompressedSize: r.compressedLen,
+		StoredSize:     r.boxLen,
+	}, nil
+}
+
+// CheckExists verifies that block exists on disk and has correct size
+// without reading it. Problems with block are reported as *BlockError.
+func CheckExists(ref *Ref) error {
+	fi, err := os.Stat(blockPath(ref))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &BlockError{ref, ErrMissing}
+		}
+		return err
+	}
+	if !isValidBoxSize(fi.Size()) {
+		return &BlockError{ref, ErrTruncated}
+	}
+	return nil
 }
 
 type Reader struct {
@@ -289,15 +479,30 @@ type Reader struct {
 	kind  uint8     // current block kind
 	refs  []*Ref    // list of block refs
 
+	// For seeking.
+	dataRefs  []*Ref // refs of all data blocks
+	blockSize int    // size of all data blocks except the last one
+	pos       int64  // current position in content
+
+	compressedLen int // length of compressed data in the current block
+	boxLen        int // length of the current block on disk
+
 	box   []byte // buffer for nonce + encrypted data
 	cdata []byte // buffer for decrypted compressed data
 }
 
-func NewReader(ref *Ref) (r *Reader, err error) {
-	r = new(Reader)
+// newBlockReader returns a new reader with the given ref
+// without loading any blocks.
+func newBlockReader(ref *Ref) *Reader {
+	r := new(Reader)
 	r.h = newHash()
 	r.box = make([]byte, nonceSize+headerSize+snappy.MaxEncodedLen(config.BlockSize)+PadSize)
 	r.refs = []*Ref{ref}
+	return r
+}
+
+func NewReader(ref *Ref) (r *Reader, err error) {
+	r = newBlockReader(ref)
 	if err := r.loadPointers(); err != nil {
 		return nil, err
 	}
@@ -305,6 +510,7 @@ func NewReader(ref *Ref) (r *Reader, err error) {
 }
 
 func (r *Reader) loadPointers() error {
+	r.dataRefs = r.refs
 	if err := r.loadBlock(); err != nil {
 		return err
 	}
@@ -322,10 +528,13 @@ func (r *Reader) loadPointers() error {
 			newrefs = append(newrefs, RefFromBytes(tmp[:]))
 		}
 		r.refs = newrefs
+		r.dataRefs = newrefs
 		if err := r.loadBlock(); err != nil {
 			return err
 		}
 	}
+	r.blockSize = len(r.block)
+	r.pos = 0
 	return nil
 }
 
@@ -349,6 +558,7 @@ func (r *Reader) Read(p []byte) (nn int, err error) {
 		copy(p, r.block[:n])
 		p = p[n:]
 		r.block = r.block[n:]
+		r.pos += int64(n)
 		nn += n
 		if len(p) == 0 {
 			return
@@ -361,6 +571,8 @@ func (r *Reader) WriteTo(w io.Writer) (nn int64, err error) {
 	for {
 		var n int
 		n, err = w.Write(r.block)
+		r.block = r.block[n:]
+		r.pos += int64(n)
 		nn += int64(n)
 		if err != nil {
 			return
@@ -377,36 +589,123 @@ func (r *Reader) WriteTo(w io.Writer) (nn int64, err error) {
 	panic("unreachable")
 }
 
+// Seek sets the position for the next Read according to whence,
+// as described in io.Seeker, and returns the new position.
+// Only the block containing the new position is loaded.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		size, err := r.size()
+		if err != nil {
+			return r.pos, err
+		}
+		offset += size
+	default:
+		return r.pos, fmt.Errorf("block: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return r.pos, fmt.Errorf("block: negative position")
+	}
+	i := len(r.dataRefs)
+	if r.blockSize > 0 {
+		if n := offset / int64(r.blockSize); n < int64(i) {
+			i = int(n)
+		}
+	}
+	r.refs = r.dataRefs[i:]
+	r.block = nil
+	r.pos = offset
+	if len(r.refs) == 0 {
+		return offset, nil // at or past the end
+	}
+	if err := r.loadBlock(); err != nil {
+		return r.pos, err
+	}
+	if len(r.refs) > 0 && len(r.block) != r.blockSize {
+		return r.pos, fmt.Errorf("block: cannot seek, block %s has unexpected size", r.dataRefs[i])
+	}
+	if skip := offset - int64(i)*int64(r.blockSize); skip < int64(len(r.block)) {
+		r.block = r.block[skip:]
+	} else {
+		r.block = nil
+	}
+	return offset, nil
+}
+
+// size returns the size of content, loading the last data block.
+func (r *Reader) size() (int64, error) {
+	n := len(r.dataRefs)
+	if n == 0 {
+		return 0, nil
+	}
+	lr := newBlockReader(r.dataRefs[n-1])
+	if err := lr.loadBlock(); err != nil {
+		return 0, err
+	}
+	return int64(n-1)*int64(r.blockSize) + int64(len(lr.block)), nil
+}
+
 func (r *Reader) loadBlock() error {
 	ref := r.refs[0]
 	r.refs = r.refs[1:]
 
+	err := r.readBlock(ref)
+	if _, ok := err.(*BlockError); ok {
+		// Try to reconstruct damaged block from parity.
+		box, perr := reconstructBox(ref)
+		if perr != nil {
+			if perr != errNoParity {
+				log.Printf("cannot reconstruct block %s: %s", ref, perr)
+			}
+			return err
+		}
+		log.Printf("reconstructed block %s from parity", ref)
+		return r.openBox(ref, box)
+	}
+	return err
+}
+
+// readBlock reads block with the given ref from disk.
+func (r *Reader) readBlock(ref *Ref) error {
 	path := blockPath(ref)
 	f, err := os.Open(path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return &BlockError{ref, ErrMissing}
+		}
 		return err
 	}
 	defer f.Close()
-	n, err := f.Read(r.box)
-	if err != nil && err != io.EOF {
+	// Block may be larger than the current BlockSize allows,
+	// e.g. if it was copied from another repository.
+	if fi, err := f.Stat(); err == nil && fi.Size() > int64(len(r.box)) {
+		r.box = make([]byte, fi.Size())
+	}
+	n, err := io.ReadFull(f, r.box)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return err
 	}
-	//if err != io.EOF {
-	//	//TODO instead we can read the actual block stored disregarding its size.
-	//	return fmt.Errorf("didn't read full block: BlockSize is smaller than stored?")
-	//}
-	if n < minBoxSize {
-		return fmt.Errorf("block on disk is too short: %s", ref)
+	if !isValidBoxSize(int64(n)) {
+		return &BlockError{ref, ErrTruncated}
 	}
+	return r.openBox(ref, r.box[:n])
+}
+
+// openBox decrypts, decompresses and verifies block box
+// and sets it as the current block.
+func (r *Reader) openBox(ref *Ref, box []byte) error {
 	// Decrypt.
 	var nonce [24]byte
-	if err := readNonce(&nonce, r.box); err != nil {
+	if err := readNonce(&nonce, box); err != nil {
 		return err
 	}
-	encryptedBlock := r.box[len(nonce):n]
+	encryptedBlock := box[len(nonce):]
 	decryptedData, ok := secretbox.Open(r.cdata[:0], encryptedBlock, &nonce, &config.Keys.BlockEnc)
 	if !ok {
-		return fmt.Errorf("failed to decrypt block %s", ref)
+		return &BlockError{ref, ErrUndecryptable}
 	}
 
 	// Load block kind.
@@ -415,6 +714,8 @@ func (r *Reader) loadBlock() error {
 	compressedLen := binary.BigEndian.Uint32(decryptedData[1:])
 
 	decryptedData = decryptedData[headerSize : headerSize+compressedLen]
+	r.compressedLen = int(compressedLen)
+	r.boxLen = len(box)
 
 	// Decompress.
 	// TODO avoid allocation.
@@ -426,7 +727,7 @@ func (r *Reader) loadBlock() error {
 	// Verify hash.
 	contentHash := calculateRef(r.h, decompressedData)
 	if !ref.Equal(contentHash) {
-		return fmt.Errorf("block ref %s doesn't match content %s", ref, contentHash)
+		return &BlockError{ref, ErrMismatch}
 	}
 
 	// Set block.
@@ -436,14 +737,22 @@ func (r *Reader) loadBlock() error {
 
 // Walks the given ref and its subrefs.
 func WalkRefs(ref *Ref, callback func(*Ref) error) error {
-	r := new(Reader)
-	r.h = newHash()
-	r.box = make([]byte, nonceSize+headerSize+snappy.MaxEncodedLen(config.BlockSize)+PadSize)
-	r.refs = []*Ref{ref}
+	return WalkTree(ref, func(r *Ref, pointer bool) error {
+		return callback(r)
+	})
+}
+
+// WalkTree walks the given ref and its subrefs like WalkRefs, but also
+// tells callback whether the block is a pointer block. Pointer blocks and
+// the first data block are read while walking, reconstructing them from
+// parity if needed, so callers that must know about damaged blocks should
+// check them with Check.
+func WalkTree(ref *Ref, callback func(ref *Ref, pointer bool) error) error {
+	r := newBlockReader(ref)
 	if err := r.loadBlock(); err != nil {
 		return err
 	}
-	if err := callback(ref); err != nil {
+	if err := callback(ref, r.kind != dataBlockKind); err != nil {
 		return err
 	}
 	var tmp [RefLen]byte
@@ -459,13 +768,16 @@ func WalkRefs(ref *Ref, callback func(*Ref) error) error {
 			}
 			newrefs = append(newrefs, RefFromBytes(tmp[:]))
 		}
+		// All blocks on the same level are of the same kind.
+		r.refs = newrefs
+		err := r.loadBlock()
+		pointer := err == nil && r.kind != dataBlockKind
 		for _, v := range newrefs {
-			if err := callback(v); err != nil {
+			if err := callback(v, pointer); err != nil {
 				return err
 			}
 		}
-		r.refs = newrefs
-		if err := r.loadBlock(); err != nil {
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,156 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/internal/testrepo"
+	"github.com/dchest/hesfic/safefile"
+)
+
+var errKilled = errors.New("killed")
+
+// store writes data into blocks and returns its ref.
+func store(data []byte) (*Ref, error) {
+	w := NewWriter()
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	return w.Finish()
+}
+
+// storeKilled stores data, killing the process (by panic, so that
+// no cleanup is done) in the middle of writing the n'th block file
+// after cut bytes. It returns false if fewer than n blocks were written.
+func storeKilled(t *testing.T, data []byte, n int, cut func(size int) int) (killed bool) {
+	orig := writeFile
+	defer func() { writeFile = orig }()
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if n--; n > 0 {
+			return orig(path, data, perm)
+		}
+		f, err := safefile.Create(path, perm)
+		if err != nil {
+			return err
+		}
+		f.Write(data[:cut(len(data))])
+		panic(errKilled)
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			if e != errKilled {
+				panic(e)
+			}
+			killed = true
+		}
+	}()
+	if _, err := store(data); err != nil {
+		t.Fatal(err)
+	}
+	return false
+}
+
+// checkStoredBlocks checks that every block file at its final path is
+// complete and readable, and returns the number of such files.
+func checkStoredBlocks(t *testing.T) int {
+	count := 0
+	err := filepath.Walk(config.BlocksPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || safefile.IsTemp(fi.Name()) {
+			return err
+		}
+		name := filepath.Base(filepath.Dir(path)) + fi.Name()
+		ref := RefFromHex([]byte(name))
+		if ref == nil {
+			t.Fatalf("bad block file name %s", path)
+		}
+		if err := Check(ref); err != nil {
+			t.Fatalf("bad block at final path: %s", err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// checkContent checks that data stored under ref equals data.
+func checkContent(t *testing.T, ref *Ref, data []byte) {
+	r, err := NewReader(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("stored content differs: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestWriteKilled(t *testing.T) {
+	defer testrepo.Use(t)()
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 30; i++ {
+		data := make([]byte, 1+rnd.Intn(5*config.BlockSize))
+		rnd.Read(data)
+		// Number of data blocks is at most 5, plus pointer block.
+		n := 1 + rnd.Intn(6)
+		killed := storeKilled(t, data, n, func(size int) int { return rnd.Intn(size) })
+		before := checkStoredBlocks(t)
+
+		// Storing the same data again must not accept partially written
+		// blocks as already stored, so that all of them are readable.
+		ref, err := store(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContent(t, ref, data)
+		if after := checkStoredBlocks(t); killed && after <= before {
+			t.Fatalf("%d: killed block wasn't stored again", i)
+		}
+	}
+}
+
+func TestTruncatedBlockReplaced(t *testing.T) {
+	defer testrepo.Use(t)()
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < 20; i++ {
+		data := make([]byte, 1+rnd.Intn(config.BlockSize))
+		rnd.Read(data)
+		ref, err := store(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Truncate the only block as if it was written in place before
+		// writes became atomic. Sizes which are multiples of PadSize can
+		// only be detected by verifying existing blocks.
+		path := blockPath(ref)
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := rnd.Int63n(fi.Size())
+		config.VerifyExistingBlocks = size%int64(PadSize) == 0
+		os.Chmod(path, 0644)
+		if err := os.Truncate(path, size); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := Check(ref); err != nil {
+			t.Fatalf("%d: truncated block to %d bytes was accepted: %s", i, size, err)
+		}
+		checkContent(t, ref, data)
+	}
+}
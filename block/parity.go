@@ -0,0 +1,507 @@
+package block
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/safefile"
+)
+
+// Parity protects blocks from damage using Reed-Solomon erasure coding.
+//
+// Newly stored blocks are collected into groups of config.ParityGroupSize
+// blocks. For each group, config.ParityBlocks parity shards are calculated
+// from encrypted blocks and stored in separate files in config.ParityPath,
+// each of which also contains group description. Any damaged or missing
+// blocks in a group, up to the number of parity shards, can be
+// reconstructed from the remaining blocks and parity shards. Group
+// description includes hashes of encrypted blocks, so that blocks which
+// were rewritten after the group was stored are treated as missing.
+// When a block is rewritten, its group is regrouped without it, and the
+// block is added to a new group.
+//
+// Parity file format: 4-byte big-endian length of group description
+// || group description in JSON || parity shard.
+
+var errNoParity = errors.New("block is not protected by parity")
+
+// parityGroup describes a group of blocks protected by parity shards.
+type parityGroup struct {
+	Refs      []*Ref   // refs of data blocks
+	Sizes     []int    // sizes of encrypted data blocks
+	ShardSize int      // size of each shard
+	Hashes    []string // SHA-256 hashes of parity shards
+
+	// SHA-256 hashes of encrypted data blocks,
+	// missing in groups stored by older versions.
+	BlockHashes []string
+
+	id    string   // group id
+	paths []string // paths to parity files, indexed by shard number
+}
+
+var parity struct {
+	sync.Mutex
+	refs  []*Ref   // refs of blocks waiting to be protected
+	boxes [][]byte // encrypted blocks waiting to be protected
+
+	index     map[Ref][]*parityGroup // groups by refs of their blocks, loaded on demand
+	indexPath string                 // parity path for which index was loaded
+}
+
+func parityEnabled() bool {
+	return config.ParityBlocks > 0 && config.ParityGroupSize > 0
+}
+
+// addToParity adds newly stored block to the current parity group,
+// storing parity for the group when it's full.
+func addToParity(ref *Ref, box []byte) error {
+	if !parityEnabled() {
+		return nil
+	}
+	parity.Lock()
+	defer parity.Unlock()
+	parity.refs = append(parity.refs, ref)
+	parity.boxes = append(parity.boxes, box)
+	if len(parity.refs) < config.ParityGroupSize {
+		return nil
+	}
+	return flushParity()
+}
+
+// FlushParity stores parity for blocks that are not yet protected,
+// even if there are not enough of them to fill a whole group.
+// It must be called after storing blocks.
+func FlushParity() error {
+	parity.Lock()
+	defer parity.Unlock()
+	return flushParity()
+}
+
+func flushParity() error {
+	if len(parity.refs) == 0 {
+		return nil
+	}
+	err := storeParityGroup(parity.refs, parity.boxes)
+	parity.refs = nil
+	parity.boxes = nil
+	return err
+}
+
+func storeParityGroup(refs []*Ref, boxes [][]byte) error {
+	var id [16]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return err
+	}
+	g := &parityGroup{
+		Refs:  refs,
+		Sizes: make([]int, len(boxes)),
+		id:    hex.EncodeToString(id[:]),
+	}
+	for i, box := range boxes {
+		g.Sizes[i] = len(box)
+		g.BlockHashes = append(g.BlockHashes, boxHash(box))
+		if len(box) > g.ShardSize {
+			g.ShardSize = len(box)
+		}
+	}
+	shards := make([][]byte, len(boxes)+config.ParityBlocks)
+	for i := range shards {
+		shards[i] = make([]byte, g.ShardSize)
+		if i < len(boxes) {
+			copy(shards[i], boxes[i])
+		}
+	}
+	enc, err := reedsolomon.New(len(boxes), config.ParityBlocks)
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return err
+	}
+	parityShards := shards[len(boxes):]
+	for _, shard := range parityShards {
+		g.Hashes = append(g.Hashes, boxHash(shard))
+	}
+	desc, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(config.ParityPath, g.id[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, shard := range parityShards {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint32(len(desc)))
+		buf.Write(desc)
+		buf.Write(shard)
+		path := filepath.Join(dir, fmt.Sprintf("%s.%d", g.id[2:], i))
+		if err := safefile.WriteFile(path, buf.Bytes(), 0444); err != nil {
+			return err
+		}
+	}
+	parity.index = nil // reload when needed
+	log.Printf("stored parity for %d blocks", len(refs))
+	return nil
+}
+
+// boxHash returns hex-encoded SHA-256 hash of encrypted block or shard.
+func boxHash(box []byte) string {
+	h := sha256.Sum256(box)
+	return hex.EncodeToString(h[:])
+}
+
+// readParityFile reads parity file at path returning its group
+// description and, if withShard is true, parity shard.
+func readParityFile(path string, withShard bool) (g *parityGroup, shard []byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var descLen uint32
+	if err := binary.Read(f, binary.BigEndian, &descLen); err != nil {
+		return nil, nil, err
+	}
+	if descLen > 1<<30 {
+		return nil, nil, fmt.Errorf("bad parity file %s", path)
+	}
+	desc := make([]byte, descLen)
+	if _, err := io.ReadFull(f, desc); err != nil {
+		return nil, nil, err
+	}
+	g = new(parityGroup)
+	if err := json.Unmarshal(desc, g); err != nil {
+		return nil, nil, err
+	}
+	if withShard {
+		shard, err = ioutil.ReadAll(f)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return g, shard, nil
+}
+
+// parseParityPath returns group id and shard number from parity file path.
+func parseParityPath(path string) (id string, n int, ok bool) {
+	name := filepath.Base(path)
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return filepath.Base(filepath.Dir(path)) + name[:i], n, true
+}
+
+// walkParityGroups calls fn for each parity group.
+func walkParityGroups(fn func(g *parityGroup) error) error {
+	groups := make(map[string]*parityGroup)
+	var ids []string
+	err := filepath.Walk(config.ParityPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == config.ParityPath {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || safefile.IsTemp(fi.Name()) {
+			return nil
+		}
+		id, n, ok := parseParityPath(path)
+		if !ok {
+			return nil
+		}
+		g := groups[id]
+		if g == nil {
+			g, _, err = readParityFile(path, false)
+			if err != nil {
+				log.Printf("bad parity file %s: %s", path, err)
+				return nil // try other files of this group
+			}
+			g.id = id
+			g.paths = make([]string, len(g.Hashes))
+			groups[id] = g
+			ids = append(ids, id)
+		}
+		if n < len(g.paths) {
+			g.paths[n] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := fn(groups[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findParityGroups returns parity groups containing block with the given
+// ref. There's more than one if the block was rewritten while its old
+// group couldn't be regrouped.
+func findParityGroups(ref *Ref) ([]*parityGroup, error) {
+	parity.Lock()
+	defer parity.Unlock()
+	if parity.index == nil || parity.indexPath != config.ParityPath {
+		index := make(map[Ref][]*parityGroup)
+		err := walkParityGroups(func(g *parityGroup) error {
+			for _, r := range g.Refs {
+				index[*r] = append(index[*r], g)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		parity.index = index
+		parity.indexPath = config.ParityPath
+	}
+	groups := parity.index[*ref]
+	if len(groups) == 0 {
+		return nil, errNoParity
+	}
+	return groups, nil
+}
+
+// blockIndex returns index of block with the given ref in group.
+func (g *parityGroup) blockIndex(ref *Ref) int {
+	for i, r := range g.Refs {
+		if r.Equal(ref) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasBox reports whether the block at index i in group is box.
+func (g *parityGroup) hasBox(i int, box []byte) bool {
+	return len(g.BlockHashes) == len(g.Refs) && len(box) == g.Sizes[i] &&
+		g.BlockHashes[i] == boxHash(box)
+}
+
+// readGroupBlock returns encrypted block at index i in group if it's
+// stored on disk unchanged since the group was stored, otherwise nil.
+func readGroupBlock(g *parityGroup, i int) []byte {
+	box, err := ioutil.ReadFile(blockPath(g.Refs[i]))
+	if err != nil || len(box) != g.Sizes[i] {
+		return nil
+	}
+	if len(g.BlockHashes) == len(g.Refs) {
+		if !g.hasBox(i, box) {
+			return nil
+		}
+		return box
+	}
+	// Older group without block hashes.
+	var nonce [24]byte
+	if err := readNonce(&nonce, box); err != nil {
+		return nil
+	}
+	if _, ok := secretbox.Open(nil, box[len(nonce):], &nonce, &config.Keys.BlockEnc); !ok {
+		return nil
+	}
+	return box
+}
+
+// reconstructBox reconstructs encrypted block with the
+// given ref from other blocks in its parity groups.
+func reconstructBox(ref *Ref) ([]byte, error) {
+	groups, err := findParityGroups(ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		var box []byte
+		box, err = reconstructFromGroup(g, g.blockIndex(ref))
+		if err == nil {
+			return box, nil
+		}
+	}
+	return nil, err
+}
+
+// reconstructFromGroup reconstructs encrypted block
+// at index target from other blocks in group.
+func reconstructFromGroup(g *parityGroup, target int) ([]byte, error) {
+	shards := make([][]byte, len(g.Refs)+len(g.Hashes))
+	for i := range g.Refs {
+		if i == target {
+			continue
+		}
+		if box := readGroupBlock(g, i); box != nil {
+			shards[i] = make([]byte, g.ShardSize)
+			copy(shards[i], box)
+		}
+	}
+	for i, path := range g.paths {
+		if path == "" {
+			continue
+		}
+		_, shard, err := readParityFile(path, true)
+		if err != nil {
+			continue
+		}
+		if len(shard) == g.ShardSize && boxHash(shard) == g.Hashes[i] {
+			shards[len(g.Refs)+i] = shard
+		}
+	}
+	enc, err := reedsolomon.New(len(g.Refs), len(g.Hashes))
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+	box := shards[target][:g.Sizes[target]]
+	if len(g.BlockHashes) == len(g.Refs) && !g.hasBox(target, box) {
+		return nil, fmt.Errorf("parity group %s reconstructed wrong block", g.id)
+	}
+	return box, nil
+}
+
+// RepairFromParity reconstructs block with the given ref from parity
+// and stores it on disk, replacing the existing damaged block.
+func RepairFromParity(ref *Ref) error {
+	box, err := reconstructBox(ref)
+	if err != nil {
+		return err
+	}
+	r := newBlockReader(ref)
+	if err := r.openBox(ref, box); err != nil {
+		return err
+	}
+	if err := writeBlockToDisk(ref, box, true); err != nil {
+		return err
+	}
+	return replaceInParity(ref, box)
+}
+
+// replaceInParity updates parity after block with the given ref was
+// rewritten on disk with box. Groups which protect a different version
+// of the block are regrouped without it, and unless some group protects
+// this version, the block is added to a new group.
+func replaceInParity(ref *Ref, box []byte) error {
+	groups, err := findParityGroups(ref)
+	if err != nil && err != errNoParity {
+		return err
+	}
+	protected := false
+	for _, g := range groups {
+		i := g.blockIndex(ref)
+		if g.hasBox(i, box) {
+			protected = true
+			continue
+		}
+		if !parityEnabled() && len(g.BlockHashes) == len(g.Refs) {
+			// Keep group to protect other blocks; the
+			// rewritten block is treated as missing.
+			continue
+		}
+		var others []int
+		for j := range g.Refs {
+			if j != i {
+				others = append(others, j)
+			}
+		}
+		if err := regroupParity(g, others); err != nil {
+			return err
+		}
+	}
+	if protected {
+		return nil
+	}
+	return addToParity(ref, box)
+}
+
+// regroupParity adds blocks at the given indexes in group to new parity
+// groups and removes the group. If any of these blocks is damaged,
+// nothing is changed, so that the group can be used to reconstruct it.
+// If parity is disabled, the group is just removed.
+func regroupParity(g *parityGroup, indexes []int) error {
+	if parityEnabled() {
+		boxes := make([][]byte, len(indexes))
+		for n, i := range indexes {
+			boxes[n] = readGroupBlock(g, i)
+			if boxes[n] == nil {
+				log.Printf("cannot regroup damaged block %s", g.Refs[i])
+				return nil
+			}
+		}
+		for n, i := range indexes {
+			if err := addToParity(g.Refs[i], boxes[n]); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("removing parity group %s", g.id)
+	for _, path := range g.paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	parity.Lock()
+	parity.index = nil // reload when needed
+	parity.Unlock()
+	return nil
+}
+
+// PruneParity removes parity of blocks that are no longer used, as
+// determined by isUsed. Blocks remaining in groups with unused blocks
+// are regrouped, so that their protection isn't weakened. For each group
+// with unused blocks, found is called with group id, the number of used
+// blocks and the number of all blocks in it. If dryRun is true, nothing
+// is changed.
+func PruneParity(isUsed func(ref *Ref) bool, dryRun bool, found func(id string, used, total int)) error {
+	err := walkParityGroups(func(g *parityGroup) error {
+		var used []int
+		for i, r := range g.Refs {
+			if isUsed(r) {
+				used = append(used, i)
+			}
+		}
+		if len(used) == len(g.Refs) {
+			return nil // all blocks are used
+		}
+		found(g.id, len(used), len(g.Refs))
+		if dryRun {
+			return nil
+		}
+		return regroupParity(g, used)
+	})
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	return FlushParity()
+}
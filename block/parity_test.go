@@ -0,0 +1,164 @@
+package block
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/internal/testrepo"
+)
+
+// useParity switches to a new temporary repository with
+// parity groups of 4 blocks protected by 2 parity shards.
+func useParity(t *testing.T) func() {
+	done := testrepo.Use(t)
+	config.ParityGroupSize = 4
+	config.ParityBlocks = 2
+	return done
+}
+
+// storeGroup stores 4 single-block contents, so that they form one
+// parity group, and returns their refs and contents.
+func storeGroup(t *testing.T, rnd *rand.Rand) ([]*Ref, [][]byte) {
+	var refs []*Ref
+	var contents [][]byte
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 1000)
+		rnd.Read(data)
+		ref, err := store(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+		contents = append(contents, data)
+	}
+	if err := FlushParity(); err != nil {
+		t.Fatal(err)
+	}
+	return refs, contents
+}
+
+// damage flips a byte in the middle of block file.
+func damage(t *testing.T, ref *Ref) {
+	path := blockPath(ref)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	os.Chmod(path, 0644)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rewrite stores damaged block again, which replaces it with a new box.
+func rewrite(t *testing.T, ref *Ref, data []byte) {
+	damage(t, ref)
+	config.VerifyExistingBlocks = true
+	defer func() { config.VerifyExistingBlocks = false }()
+	if _, err := store(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushParity(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// groupsOf returns parity groups containing block with the given ref.
+func groupsOf(t *testing.T, ref *Ref) []*parityGroup {
+	groups, err := findParityGroups(ref)
+	if err != nil && err != errNoParity {
+		t.Fatal(err)
+	}
+	return groups
+}
+
+func repairFromParity(t *testing.T, ref *Ref, data []byte) {
+	if err := RepairFromParity(ref); err != nil {
+		t.Fatalf("repair from parity: %s", err)
+	}
+	checkContent(t, ref, data)
+}
+
+func TestParityRewrittenBlock(t *testing.T) {
+	defer useParity(t)()
+	refs, contents := storeGroup(t, rand.New(rand.NewSource(1)))
+	old := groupsOf(t, refs[0])[0]
+
+	// Rewritten block is added to a new group,
+	// and the rest of its old group is regrouped.
+	rewrite(t, refs[0], contents[0])
+	for i, ref := range refs {
+		groups := groupsOf(t, ref)
+		if len(groups) != 1 || groups[0].id == old.id {
+			t.Fatalf("block %d: not regrouped", i)
+		}
+		box, err := ioutil.ReadFile(blockPath(ref))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !groups[0].hasBox(groups[0].blockIndex(ref), box) {
+			t.Fatalf("block %d: group has wrong hash", i)
+		}
+	}
+	damage(t, refs[0])
+	damage(t, refs[1])
+	repairFromParity(t, refs[0], contents[0])
+	repairFromParity(t, refs[1], contents[1])
+	if groups := groupsOf(t, refs[0]); len(groups) != 1 {
+		t.Fatalf("block repaired from parity is in %d groups", len(groups))
+	}
+}
+
+func TestParityRewrittenBlockDamagedGroup(t *testing.T) {
+	defer useParity(t)()
+	refs, contents := storeGroup(t, rand.New(rand.NewSource(2)))
+
+	// Old group can't be regrouped because of damaged block,
+	// so it's kept with the stale box of the rewritten block,
+	// which must be treated as missing when reconstructing.
+	damage(t, refs[1])
+	rewrite(t, refs[0], contents[0])
+	if groups := groupsOf(t, refs[0]); len(groups) != 2 {
+		t.Fatalf("rewritten block is in %d groups, want 2", len(groups))
+	}
+	repairFromParity(t, refs[1], contents[1])
+	checkContent(t, refs[0], contents[0])
+}
+
+func TestPruneParityDamaged(t *testing.T) {
+	defer useParity(t)()
+	refs, contents := storeGroup(t, rand.New(rand.NewSource(3)))
+	unused := *refs[0]
+	isUsed := func(ref *Ref) bool { return *ref != unused }
+
+	// Group with damaged used block is kept
+	// as is, without regrouping any blocks.
+	damage(t, refs[2])
+	if err := PruneParity(isUsed, false, func(string, int, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	for i, ref := range refs {
+		if groups := groupsOf(t, ref); len(groups) != 1 {
+			t.Fatalf("block %d is in %d groups, want 1", i, len(groups))
+		}
+	}
+	repairFromParity(t, refs[2], contents[2])
+
+	// After repair, used blocks are regrouped.
+	old := groupsOf(t, refs[1])[0]
+	if err := PruneParity(isUsed, false, func(string, int, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if groups := groupsOf(t, refs[0]); len(groups) != 0 {
+		t.Fatalf("unused block is in %d groups", len(groups))
+	}
+	for i, ref := range refs[1:] {
+		if groups := groupsOf(t, ref); len(groups) != 1 || groups[0].id == old.id {
+			t.Fatalf("block %d: not regrouped", i+1)
+		}
+	}
+}
@@ -11,6 +11,11 @@ import (
 const (
 	minBlockSize     = 64 * 1024       /* 64 KiB */
 	defaultBlockSize = 2 * 1024 * 1024 /* 2 MiB */
+
+	defaultParityGroupSize = 10
+	maxParityShards        = 256
+
+	defaultChangedFileRetries = 3
 )
 
 // Maximum size of block.
@@ -22,13 +27,64 @@ var BlocksPath string
 // Path for snapshots.
 var SnapshotsPath string
 
-// Issue fsync call when writing blocks.
+// Path for repository locks.
+var LocksPath string
+
+// Path for parity of blocks.
+var ParityPath string
+
+// Number of blocks in a parity group and number of parity blocks
+// calculated for each group. If ParityBlocks is zero, blocks are
+// stored without parity.
+var (
+	ParityGroupSize = defaultParityGroupSize
+	ParityBlocks    = 0
+)
+
+// Issue fsync call when restoring files.
+// Blocks and snapshots are always synced.
 var FileSync = false
 
+// Verify blocks that already exist on disk when storing the same blocks,
+// and replace them if they are damaged.
+var VerifyExistingBlocks = false
+
+// Error policies for files that cannot be read when creating snapshots.
+const (
+	OnErrorSkip  = "skip"  // skip file and record it in snapshot
+	OnErrorAbort = "abort" // fail to create snapshot
+)
+
+// What to do with files that cannot be read when creating snapshots.
+var OnError = OnErrorSkip
+
+// Number of times to read file again if it changes
+// while being read when creating snapshots.
+var ChangedFileRetries = defaultChangedFileRetries
+
+// Commands to run before and after operations.
+var Hooks []*Hook
+
+// Patterns of files to exclude when creating snapshots.
+// Patterns containing path separator are matched against
+// absolute path of file, others against its name.
+var Exclude []string
+
+// Backup profiles by name.
+var Profiles map[string]*Profile
+
 type serializedConfig struct {
-	BlockSize int
-	OutPath   string
-	FileSync  bool
+	BlockSize            int
+	OutPath              string
+	FileSync             bool
+	VerifyExistingBlocks bool
+	ParityGroupSize      int
+	ParityBlocks         int
+	OnError              string
+	ChangedFileRetries   *int
+	Hooks                []*Hook
+	Exclude              []string
+	Profiles             map[string]*Profile
 }
 
 func Load(configPath string) error {
@@ -51,12 +107,147 @@ func Load(configPath string) error {
 		BlockSize = sc.BlockSize
 	}
 	FileSync = sc.FileSync
-	BlocksPath = filepath.Join(sc.OutPath, "blocks")
-	SnapshotsPath = filepath.Join(sc.OutPath, "snapshots")
+	VerifyExistingBlocks = sc.VerifyExistingBlocks
+	if sc.ParityGroupSize != 0 {
+		ParityGroupSize = sc.ParityGroupSize
+	}
+	ParityBlocks = sc.ParityBlocks
+	if ParityGroupSize < 1 || ParityBlocks < 0 || ParityGroupSize+ParityBlocks > maxParityShards {
+		return fmt.Errorf("bad ParityGroupSize or ParityBlocks: their sum must not exceed %d", maxParityShards)
+	}
+	switch sc.OnError {
+	case "":
+		OnError = OnErrorSkip
+	case OnErrorSkip, OnErrorAbort:
+		OnError = sc.OnError
+	default:
+		return fmt.Errorf("bad OnError %q, expecting %q or %q", sc.OnError, OnErrorSkip, OnErrorAbort)
+	}
+	ChangedFileRetries = defaultChangedFileRetries
+	if sc.ChangedFileRetries != nil {
+		if *sc.ChangedFileRetries < 0 {
+			return fmt.Errorf("ChangedFileRetries must not be negative")
+		}
+		ChangedFileRetries = *sc.ChangedFileRetries
+	}
+	for _, h := range sc.Hooks {
+		if err := h.validate(); err != nil {
+			return err
+		}
+	}
+	Hooks = sc.Hooks
+	if err := ValidatePatterns(sc.Exclude); err != nil {
+		return err
+	}
+	Exclude = sc.Exclude
+	for name, p := range sc.Profiles {
+		if err := p.validate(name); err != nil {
+			return err
+		}
+	}
+	Profiles = sc.Profiles
+	SetOutPath(sc.OutPath)
+	return nil
+}
+
+// SetOutPath sets paths of repository in the given output directory.
+func SetOutPath(outPath string) {
+	BlocksPath = filepath.Join(outPath, "blocks")
+	SnapshotsPath = filepath.Join(outPath, "snapshots")
+	LocksPath = filepath.Join(outPath, "locks")
+	ParityPath = filepath.Join(outPath, "parity")
+}
+
+// ValidatePatterns returns error if any of patterns of files
+// to exclude is malformed.
+func ValidatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %s", p, err)
+		}
+	}
 	return nil
 }
 
 func MakePaths() {
 	os.MkdirAll(BlocksPath, 0755)
 	os.MkdirAll(SnapshotsPath, 0755)
+	os.MkdirAll(LocksPath, 0755)
+}
+
+// Settings contains configuration and keys of a repository.
+//
+// Since configuration is global, working with several repositories,
+// e.g. when copying snapshots between them, is done by loading settings
+// for each repository and switching between them with Use.
+type Settings struct {
+	BlockSize            int
+	BlocksPath           string
+	SnapshotsPath        string
+	LocksPath            string
+	ParityPath           string
+	FileSync             bool
+	VerifyExistingBlocks bool
+	ParityGroupSize      int
+	ParityBlocks         int
+	OnError              string
+	ChangedFileRetries   int
+	Hooks                []*Hook
+	Exclude              []string
+	Keys                 KeySet
+}
+
+// Current returns current settings.
+func Current() *Settings {
+	return &Settings{
+		BlockSize:            BlockSize,
+		BlocksPath:           BlocksPath,
+		SnapshotsPath:        SnapshotsPath,
+		LocksPath:            LocksPath,
+		ParityPath:           ParityPath,
+		FileSync:             FileSync,
+		VerifyExistingBlocks: VerifyExistingBlocks,
+		ParityGroupSize:      ParityGroupSize,
+		ParityBlocks:         ParityBlocks,
+		OnError:              OnError,
+		ChangedFileRetries:   ChangedFileRetries,
+		Hooks:                Hooks,
+		Exclude:              Exclude,
+		Keys:                 Keys,
+	}
+}
+
+// Use makes settings current. Settings are read without synchronization,
+// so Use must not be called while other goroutines may read them, such as
+// a goroutine reporting progress or scanning files. Lock refreshing is
+// not affected, since locks remember their paths and keys.
+func (s *Settings) Use() {
+	BlockSize = s.BlockSize
+	BlocksPath = s.BlocksPath
+	SnapshotsPath = s.SnapshotsPath
+	LocksPath = s.LocksPath
+	ParityPath = s.ParityPath
+	FileSync = s.FileSync
+	VerifyExistingBlocks = s.VerifyExistingBlocks
+	ParityGroupSize = s.ParityGroupSize
+	ParityBlocks = s.ParityBlocks
+	OnError = s.OnError
+	ChangedFileRetries = s.ChangedFileRetries
+	Hooks = s.Hooks
+	Exclude = s.Exclude
+	Keys = s.Keys
+}
+
+// LoadSettings loads settings from the given config and keys files
+// without changing current settings.
+func LoadSettings(configPath, keysPath string) (*Settings, error) {
+	cur := Current()
+	defer cur.Use()
+	if err := Load(configPath); err != nil {
+		return nil, err
+	}
+	if err := LoadKeys(keysPath); err != nil {
+		return nil, err
+	}
+	return Current(), nil
 }
@@ -0,0 +1,48 @@
+package config
+
+import "fmt"
+
+// Hook is a shell command to run before or after an operation.
+type Hook struct {
+	Event     string // when to run, e.g. "pre-create" or "post-gc"
+	Command   string // shell command
+	OnFailure string // what to do if command fails: "abort", "warn" or "ignore"
+}
+
+// Events for which hooks can be defined.
+var HookEvents = []string{
+	"pre-create", "post-create",
+	"pre-gc", "post-gc",
+	"pre-restore", "post-restore",
+}
+
+// Hook failure policies.
+const (
+	HookAbort  = "abort"  // fail operation (default)
+	HookWarn   = "warn"   // print warning and continue
+	HookIgnore = "ignore" // continue silently
+)
+
+func (h *Hook) validate() error {
+	known := false
+	for _, e := range HookEvents {
+		if h.Event == e {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown hook event %q", h.Event)
+	}
+	if h.Command == "" {
+		return fmt.Errorf("%s hook has no command", h.Event)
+	}
+	switch h.OnFailure {
+	case "":
+		h.OnFailure = HookAbort
+	case HookAbort, HookWarn, HookIgnore:
+	default:
+		return fmt.Errorf("bad OnFailure %q of %s hook, expecting abort, warn or ignore", h.OnFailure, h.Event)
+	}
+	return nil
+}
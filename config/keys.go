@@ -8,13 +8,16 @@ import (
 	"os"
 )
 
-// Secret keys.
-var Keys struct {
+// KeySet is a set of secret keys.
+type KeySet struct {
 	RefHash     [32]byte // MAC key for refs
 	BlockEnc    [32]byte // block encryption key
 	SnapshotEnc [32]byte // snapshot encryption key
 }
 
+// Secret keys.
+var Keys KeySet
+
 const keysLen = 32 + 32 + 32
 
 func LoadKeys(keysPath string) error {
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = time.Minute
+)
+
+// Profile describes a backup job: what to back up, where, and which
+// snapshots to keep.
+type Profile struct {
+	Name    string   `json:"-"`
+	Sources []string // files and directories to back up
+	Exclude []string // patterns of files to exclude, in addition to global ones
+	OutPath string   // output directory of repository, if different from global
+	Keys    string   // path to keys file, if different from global
+	Tags    []string // tags of snapshots in addition to profile name
+	Comment string   // comment of snapshots
+	Keep    *Retention
+	Hooks   []*Hook // hooks to run after global ones
+
+	// Daemon settings.
+	Schedule   string // cron-like schedule, empty if not scheduled
+	Retries    *int   // number of retries after failed run
+	RetryDelay string // delay before the first retry, e.g. "5m"
+}
+
+// RetrySettings returns the number of retries and delay
+// before the first retry of failed scheduled runs.
+func (p *Profile) RetrySettings() (retries int, delay time.Duration) {
+	retries, delay = defaultRetries, defaultRetryDelay
+	if p.Retries != nil {
+		retries = *p.Retries
+	}
+	if p.RetryDelay != "" {
+		delay, _ = time.ParseDuration(p.RetryDelay) // validated on load
+	}
+	return
+}
+
+// Retention is a policy of which snapshots of profile to keep
+// after backup. Snapshots not kept by any of rules are removed.
+type Retention struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	Within  string   // duration, e.g. "10d" (see ParseDuration)
+	Tags    []string // keep snapshots with any of these tags
+}
+
+func (r *Retention) validate() error {
+	if r.Last < 0 || r.Hourly < 0 || r.Daily < 0 || r.Weekly < 0 || r.Monthly < 0 || r.Yearly < 0 {
+		return fmt.Errorf("Keep must not have negative numbers")
+	}
+	within, err := ParseDuration(r.Within)
+	if err != nil {
+		return fmt.Errorf("Keep: %s", err)
+	}
+	if r.Last == 0 && r.Hourly == 0 && r.Daily == 0 && r.Weekly == 0 &&
+		r.Monthly == 0 && r.Yearly == 0 && within == 0 && len(r.Tags) == 0 {
+		return fmt.Errorf("Keep doesn't keep any snapshots")
+	}
+	return nil
+}
+
+// ParseDuration parses duration, which in addition to time.ParseDuration
+// format can be given in days (d), weeks (w), 30-day months (mo) or 365-day
+// years (y). A number of minutes alone ("6m") is rejected, since it's easy
+// to mistake for months.
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"mo", 30 * 24 * time.Hour},
+		{"y", 365 * 24 * time.Hour},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, u.suffix))
+			if err != nil {
+				return 0, fmt.Errorf("bad duration %q", s)
+			}
+			return time.Duration(n) * u.unit, nil
+		}
+	}
+	if _, err := strconv.Atoi(strings.TrimSuffix(s, "m")); err == nil && strings.HasSuffix(s, "m") {
+		return 0, fmt.Errorf("ambiguous duration %q: use \"mo\" for months", s)
+	}
+	return time.ParseDuration(s)
+}
+
+func (p *Profile) validate(name string) error {
+	p.Name = name
+	if name == "" {
+		return fmt.Errorf("profile has no name")
+	}
+	if len(p.Sources) == 0 {
+		return fmt.Errorf("profile %s has no sources", name)
+	}
+	if err := ValidatePatterns(p.Exclude); err != nil {
+		return fmt.Errorf("profile %s: %s", name, err)
+	}
+	if p.Keep != nil {
+		if err := p.Keep.validate(); err != nil {
+			return fmt.Errorf("profile %s: %s", name, err)
+		}
+	}
+	for _, h := range p.Hooks {
+		if err := h.validate(); err != nil {
+			return fmt.Errorf("profile %s: %s", name, err)
+		}
+	}
+	if p.Retries != nil && *p.Retries < 0 {
+		return fmt.Errorf("profile %s: Retries must not be negative", name)
+	}
+	if p.RetryDelay != "" {
+		if d, err := time.ParseDuration(p.RetryDelay); err != nil || d <= 0 {
+			return fmt.Errorf("profile %s: bad RetryDelay %q", name, p.RetryDelay)
+		}
+	}
+	return nil
+}
+
+// Use changes current configuration to run profile: sets its
+// repository and keys, and adds its excludes and hooks.
+// Use Current and Settings.Use to restore the previous one.
+func (p *Profile) Use() error {
+	if p.OutPath != "" {
+		SetOutPath(p.OutPath)
+	}
+	if p.Keys != "" {
+		if err := LoadKeys(p.Keys); err != nil {
+			return err
+		}
+	}
+	Exclude = append(append([]string(nil), Exclude...), p.Exclude...)
+	Hooks = append(append([]*Hook(nil), Hooks...), p.Hooks...)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/daemon"
+	"github.com/dchest/hesfic/web"
+)
+
+// runDaemon runs backup profiles on their schedules until interrupted.
+// If address is given in argument, it also serves web interface,
+// which shows status of scheduled backups.
+func runDaemon(configPath, keysPath string) error {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var jobs []*daemon.Job
+	for _, name := range names {
+		p := config.Profiles[name]
+		if p.Schedule == "" {
+			continue
+		}
+		retries, delay := p.RetrySettings()
+		jobs = append(jobs, &daemon.Job{
+			Profile:    name,
+			Schedule:   p.Schedule,
+			Retries:    retries,
+			RetryDelay: delay,
+		})
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("no profiles with Schedule in config")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return err
+	}
+	if keysPath, err = filepath.Abs(keysPath); err != nil {
+		return err
+	}
+	backupArgs := []string{"-config", configPath, "-keys", keysPath}
+	if *logFlag {
+		backupArgs = append(backupArgs, "-log")
+	}
+	if *hostFlag != "" {
+		backupArgs = append(backupArgs, "-host", *hostFlag)
+	}
+	if *userFlag != "" {
+		backupArgs = append(backupArgs, "-user", *userFlag)
+	}
+	if *onErrorFlag != "" {
+		backupArgs = append(backupArgs, "-on-error", *onErrorFlag)
+	}
+	d, err := daemon.New(jobs, func(profile string) (bool, error) {
+		return runBackupProcess(exe, backupArgs, profile)
+	}, daemon.RealClock)
+	if err != nil {
+		return err
+	}
+	if addr := arg(1); addr != "" {
+		web.DaemonStatus = d.Status
+		go func() {
+			if err := web.Serve(addr); err != nil {
+				fatal("error: %s", err)
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Printf("stopping daemon")
+		close(stop)
+	}()
+	log.Printf("daemon started with %d scheduled profiles", len(jobs))
+	return d.Run(stop)
+}
+
+// runBackupProcess runs "hesfic backup" for profile in a separate
+// process, so that changing configuration for profile and exiting
+// on errors doesn't affect daemon.
+func runBackupProcess(exe string, args []string, profile string) (partial bool, err error) {
+	cmd := exec.Command(exe, append(args, "backup", profile)...)
+	var errLine lastErrorWriter
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &errLine)
+	err = cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ee.ExitCode() == exitPartial {
+			return true, nil
+		}
+		if msg := errLine.String(); msg != "" {
+			return false, fmt.Errorf("%s", msg)
+		}
+	}
+	return false, err
+}
+
+// lastErrorWriter remembers the last line written to it,
+// which contains an error, or the last line if there's none.
+type lastErrorWriter struct {
+	buf       []byte
+	lastError string
+	last      string
+}
+
+func (w *lastErrorWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(w.buf[:i])); line != "" {
+			w.last = line
+			if j := strings.Index(line, "error: "); j >= 0 {
+				w.lastError = line[j+len("error: "):]
+			}
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lastErrorWriter) String() string {
+	if w.lastError != "" {
+		return w.lastError
+	}
+	return w.last
+}
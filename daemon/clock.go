@@ -0,0 +1,18 @@
+package daemon
+
+import "time"
+
+// Clock provides current time and timers, so that
+// daemon can be run with a simulated clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is a clock which uses system time.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
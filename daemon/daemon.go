@@ -0,0 +1,197 @@
+// Package daemon runs backup jobs on schedules.
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Job describes a scheduled backup job.
+type Job struct {
+	Profile    string        // name of backup profile
+	Schedule   string        // schedule, see Schedule
+	Retries    int           // number of retries after failed run
+	RetryDelay time.Duration // delay before the first retry, doubled for each next one
+}
+
+// Runner runs backup of profile with the given name. It returns error
+// if backup failed, or partial set to true if backup was created, but
+// some files were skipped.
+type Runner func(profile string) (partial bool, err error)
+
+// Maximum delay before retrying failed run.
+const maxRetryDelay = 24 * time.Hour
+
+// Results of runs.
+const (
+	ResultOK      = "ok"
+	ResultPartial = "partial"
+	ResultFailed  = "failed"
+)
+
+// Status describes state of job.
+type Status struct {
+	Profile   string
+	Schedule  string
+	Running   bool
+	Runs      int       // number of runs, including retries
+	Failures  int       // number of consecutive failed runs
+	LastStart time.Time // zero if never run
+	LastEnd   time.Time
+	Result    string    `json:",omitempty"` // result of the last run
+	Error     string    `json:",omitempty"` // error of the last run
+	LastOK    time.Time // end of the last successful run
+	NextRun   time.Time // zero if never
+	Retry     bool      // next run is a retry
+}
+
+type job struct {
+	Job
+	schedule *Schedule
+	attempt  int // number of retries of the current scheduled run
+	status   Status
+}
+
+// Daemon runs jobs on their schedules one at a time, so that jobs
+// don't wait for each other's repository locks.
+type Daemon struct {
+	clock Clock
+	run   Runner
+
+	mu   sync.Mutex
+	jobs []*job
+}
+
+// New returns a new daemon, which runs jobs with run using clock.
+func New(jobs []*Job, run Runner, clock Clock) (*Daemon, error) {
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no jobs to run")
+	}
+	d := &Daemon{clock: clock, run: run}
+	now := clock.Now()
+	for _, j := range jobs {
+		s, err := ParseSchedule(j.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %s", j.Profile, err)
+		}
+		dj := &job{Job: *j, schedule: s}
+		dj.status.Profile = j.Profile
+		dj.status.Schedule = j.Schedule
+		dj.status.NextRun = s.Next(now)
+		d.jobs = append(d.jobs, dj)
+	}
+	return d, nil
+}
+
+// Status returns status of jobs.
+func (d *Daemon) Status() []*Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]*Status, len(d.jobs))
+	for i, j := range d.jobs {
+		st := j.status
+		list[i] = &st
+	}
+	return list
+}
+
+// nextJob returns job which should run first.
+func (d *Daemon) nextJob() *job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var next *job
+	for _, j := range d.jobs {
+		if j.status.NextRun.IsZero() {
+			continue // never
+		}
+		if next == nil || j.status.NextRun.Before(next.status.NextRun) {
+			next = j
+		}
+	}
+	return next
+}
+
+// Run runs jobs until stop is closed. A running job is
+// not interrupted: Run returns after it finishes.
+func (d *Daemon) Run(stop <-chan struct{}) error {
+	for {
+		j := d.nextJob()
+		if j == nil {
+			return fmt.Errorf("no jobs are scheduled")
+		}
+		if wait := j.status.NextRun.Sub(d.clock.Now()); wait > 0 {
+			select {
+			case <-stop:
+				return nil
+			case <-d.clock.After(wait):
+				continue // find next job again
+			}
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		d.runJob(j)
+	}
+}
+
+// runJob runs job and schedules its next run.
+func (d *Daemon) runJob(j *job) {
+	d.mu.Lock()
+	j.status.Running = true
+	j.status.LastStart = d.clock.Now()
+	d.mu.Unlock()
+
+	log.Printf("running profile %s", j.Profile)
+	partial, err := d.run(j.Profile)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.clock.Now()
+	st := &j.status
+	st.Running = false
+	st.Runs++
+	st.LastEnd = now
+	st.Error = ""
+	st.Retry = false
+	next := j.schedule.Next(now)
+	switch {
+	case err != nil:
+		st.Result = ResultFailed
+		st.Error = err.Error()
+		st.Failures++
+		log.Printf("profile %s failed: %s", j.Profile, err)
+		if j.attempt < j.Retries {
+			j.attempt++
+			delay := j.RetryDelay
+			for i := 1; i < j.attempt && delay < maxRetryDelay; i++ {
+				delay *= 2
+			}
+			if delay <= 0 || delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			retry := now.Add(delay)
+			if next.IsZero() || retry.Before(next) {
+				log.Printf("retrying profile %s at %s", j.Profile, retry.Format(time.RFC1123))
+				st.NextRun = retry
+				st.Retry = true
+				return
+			}
+		}
+	case partial:
+		st.Result = ResultPartial
+		st.Failures = 0
+		st.LastOK = now
+		log.Printf("profile %s finished, but some files were skipped", j.Profile)
+	default:
+		st.Result = ResultOK
+		st.Failures = 0
+		st.LastOK = now
+		log.Printf("profile %s finished", j.Profile)
+	}
+	j.attempt = 0
+	st.NextRun = next
+}
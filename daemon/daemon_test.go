@@ -0,0 +1,228 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock in which waiting advances time instantly.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// stoppedClock is a clock in which waiting never ends.
+type stoppedClock struct {
+	now time.Time
+}
+
+func (c *stoppedClock) Now() time.Time                         { return c.now }
+func (c *stoppedClock) After(d time.Duration) <-chan time.Time { return nil }
+
+var errFailed = errors.New("failed")
+
+// runFailing runs job which always fails with the fake clock starting at
+// start until it's run n times, and returns times at which it was started.
+func runFailing(t *testing.T, job *Job, start time.Time, n int) []time.Time {
+	clock := &fakeClock{now: start}
+	stop := make(chan struct{})
+	var starts []time.Time
+	run := func(profile string) (bool, error) {
+		starts = append(starts, clock.Now())
+		clock.now = clock.now.Add(time.Minute)
+		if len(starts) == n {
+			close(stop)
+		}
+		return false, errFailed
+	}
+	d, err := New([]*Job{job}, run, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(stop); err != nil {
+		t.Fatal(err)
+	}
+	if len(starts) != n {
+		t.Fatalf("job ran %d times, want %d", len(starts), n)
+	}
+	st := d.Status()[0]
+	if st.Runs != n || st.Failures != n || st.Result != ResultFailed || st.Error != errFailed.Error() {
+		t.Fatalf("bad status: %+v", st)
+	}
+	return starts
+}
+
+func TestRetryBackoff(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC)
+	job := &Job{Profile: "p", Schedule: "@daily", Retries: 5, RetryDelay: time.Hour}
+	starts := runFailing(t, job, start, 8)
+	// Delays are doubled after each retry, but the fifth retry,
+	// which would be 16 hours later, is replaced by the next run.
+	want := []time.Time{
+		time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 2, 1, 1, 0, 0, time.UTC),
+		time.Date(2021, 1, 2, 3, 2, 0, 0, time.UTC),
+		time.Date(2021, 1, 2, 7, 3, 0, 0, time.UTC),
+		time.Date(2021, 1, 2, 15, 4, 0, 0, time.UTC),
+		time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 3, 1, 1, 0, 0, time.UTC),
+		time.Date(2021, 1, 3, 3, 2, 0, 0, time.UTC),
+	}
+	for i := range want {
+		if !starts[i].Equal(want[i]) {
+			t.Fatalf("run %d started at %s, want %s", i, starts[i], want[i])
+		}
+	}
+}
+
+func TestRetryDelayLimit(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC)
+	for _, delay := range []time.Duration{time.Hour, 100 * time.Hour, 1 << 62} {
+		job := &Job{Profile: "p", Schedule: "@yearly", Retries: 70, RetryDelay: delay}
+		starts := runFailing(t, job, start, 71)
+		for i := 1; i < len(starts); i++ {
+			want := maxRetryDelay
+			if delay == time.Hour && i <= 5 {
+				want = time.Hour << uint(i-1)
+			}
+			if got := starts[i].Sub(starts[i-1]) - time.Minute; got != want {
+				t.Fatalf("delay %s: retry %d after %s, want %s", delay, i, got, want)
+			}
+		}
+	}
+}
+
+func TestRetryBeforeNextRun(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC)
+	job := &Job{Profile: "p", Schedule: "*/10 * * * *", Retries: 3, RetryDelay: 20 * time.Minute}
+	starts := runFailing(t, job, start, 3)
+	for i, s := range starts {
+		if want := time.Date(2021, 1, 1, 0, 10*(i+1), 0, 0, time.UTC); !s.Equal(want) {
+			t.Fatalf("run %d started at %s, want %s", i, s, want)
+		}
+	}
+}
+
+func TestRetryResetAfterSuccess(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC)}
+	stop := make(chan struct{})
+	var starts []time.Time
+	results := []error{errFailed, nil, errFailed, errFailed}
+	run := func(profile string) (bool, error) {
+		starts = append(starts, clock.Now())
+		err := results[len(starts)-1]
+		if len(starts) == len(results) {
+			close(stop)
+		}
+		return false, err
+	}
+	job := &Job{Profile: "p", Schedule: "@daily", Retries: 2, RetryDelay: time.Hour}
+	d, err := New([]*Job{job}, run, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(stop); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{
+		time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 2, 1, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 3, 1, 0, 0, 0, time.UTC),
+	}
+	for i := range want {
+		if !starts[i].Equal(want[i]) {
+			t.Fatalf("run %d started at %s, want %s", i, starts[i], want[i])
+		}
+	}
+	st := d.Status()[0]
+	if st.Failures != 2 || !st.Retry || !st.LastOK.Equal(want[1]) ||
+		!st.NextRun.Equal(want[3].Add(2*time.Hour)) {
+		t.Fatalf("bad status: %+v", st)
+	}
+}
+
+func TestRunJobsInOrder(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC)}
+	stop := make(chan struct{})
+	var runs []string
+	run := func(profile string) (bool, error) {
+		runs = append(runs, profile+clock.Now().Format(" 15:04"))
+		if len(runs) == 6 {
+			close(stop)
+		}
+		return profile == "b", nil
+	}
+	jobs := []*Job{
+		{Profile: "a", Schedule: "@hourly"},
+		{Profile: "b", Schedule: "30 * * * *"},
+		{Profile: "c", Schedule: "@daily"},
+	}
+	d, err := New(jobs, run, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(stop); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"b 00:30", "a 01:00", "b 01:30", "a 02:00", "b 02:30", "a 03:00"}
+	for i := range want {
+		if runs[i] != want[i] {
+			t.Fatalf("runs: %q, want %q", runs, want)
+		}
+	}
+	for _, st := range d.Status() {
+		want := ResultOK
+		if st.Profile == "b" {
+			want = ResultPartial
+		}
+		if st.Profile != "c" && (st.Result != want || st.Failures != 0 || !st.LastOK.Equal(st.LastEnd)) {
+			t.Fatalf("bad status: %+v", st)
+		}
+	}
+}
+
+func TestRunStop(t *testing.T) {
+	clock := &stoppedClock{now: time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC)}
+	run := func(profile string) (bool, error) {
+		t.Fatalf("job ran")
+		return false, nil
+	}
+	d, err := New([]*Job{{Profile: "p", Schedule: "@daily"}}, run, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- d.Run(stop) }()
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after stop")
+	}
+}
+
+func TestRunNotScheduled(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC)}
+	run := func(profile string) (bool, error) { return false, nil }
+	d, err := New([]*Job{{Profile: "p", Schedule: "0 0 30 2 *"}}, run, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(make(chan struct{})); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,179 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron-like schedule.
+//
+// It is either five space-separated fields: minute (0-59), hour (0-23),
+// day of month (1-31), month (1-12) and day of week (0-7, both 0 and 7
+// are Sunday), each of which is "*" or comma-separated list of values
+// and ranges ("1-5"), optionally with step ("*/15", "0-30/10"); or one
+// of @hourly, @daily (@midnight), @weekly, @monthly, @yearly (@annually),
+// or "@every <duration>", e.g. "@every 6h".
+//
+// As in cron, if both day of month and day of week are restricted,
+// a day matches if either of them matches.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets of matching values
+	domAny, dowAny                bool   // day of month or week is "*"
+	every                         time.Duration
+}
+
+var scheduleAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parses schedule.
+func ParseSchedule(s string) (*Schedule, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(s[len("@every "):]))
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("bad schedule %q: expecting duration of at least 1m", s)
+		}
+		return &Schedule{every: d}, nil
+	}
+	if alias, ok := scheduleAliases[s]; ok {
+		s = alias
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad schedule %q: expecting 5 fields", s)
+	}
+	var sc Schedule
+	var err error
+	parsers := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&sc.minute, 0, 59},
+		{&sc.hour, 0, 23},
+		{&sc.dom, 1, 31},
+		{&sc.month, 1, 12},
+		{&sc.dow, 0, 7},
+	}
+	for i, p := range parsers {
+		if *p.bits, err = parseField(fields[i], p.min, p.max); err != nil {
+			return nil, fmt.Errorf("bad schedule %q: %s", s, err)
+		}
+	}
+	if sc.dow&(1<<7) != 0 {
+		sc.dow |= 1 // 7 is Sunday
+	}
+	sc.domAny = fields[2] == "*"
+	sc.dowAny = fields[4] == "*"
+	return &sc, nil
+}
+
+// parseField parses schedule field with values from min to max.
+func parseField(field string, min, max int) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max // "a/n" means from a to max with step n
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t matching schedule, or zero time
+// if there's no such time in the next five years. For "@every" schedules,
+// it returns t plus duration.
+//
+// Schedule is matched against local wall clock time, so on daylight
+// saving time changes, a time that is skipped runs once right after
+// the change, and a time that is repeated runs only once.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	w := wallClock(t)
+	limit := w.Year() + 5
+	for {
+		if w = s.nextWall(w, limit); w.IsZero() {
+			return w
+		}
+		y, m, d := w.Date()
+		next := time.Date(y, m, d, w.Hour(), w.Minute(), 0, 0, t.Location())
+		if nw := wallClock(next); !nw.Equal(w) {
+			next = next.Add(w.Sub(nw)) // skipped time, move past the gap
+		}
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+// wallClock returns wall clock time of t to the minute as time in UTC.
+func wallClock(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// nextWall returns the first wall clock time after w, given in UTC,
+// matching schedule, or zero time if there's no such time until the
+// end of the limit year.
+func (s *Schedule) nextWall(w time.Time, limit int) time.Time {
+	w = w.Add(time.Minute)
+	for w.Year() <= limit {
+		y, m, d := w.Date()
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			w = time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(w):
+			w = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(w.Hour())) == 0:
+			w = time.Date(y, m, d, w.Hour()+1, 0, 0, 0, time.UTC)
+		case s.minute&(1<<uint(w.Minute())) == 0:
+			w = w.Add(time.Minute)
+		default:
+			return w
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func parseTime(t *testing.T, s string, loc *time.Location) time.Time {
+	tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		schedule, from, want string
+	}{
+		{"*/15 * * * *", "2021-01-01 10:07", "2021-01-01 10:15"},
+		{"*/15 * * * *", "2021-01-01 10:45", "2021-01-01 11:00"},
+		{"0-30/10 9-17 * * 1-5", "2021-01-01 17:31", "2021-01-04 09:00"}, // Friday to Monday
+		{"5 4 * * 7", "2021-01-01 00:00", "2021-01-03 04:05"},            // 7 is Sunday
+		{"5 4 * * 0", "2021-01-03 04:05", "2021-01-10 04:05"},
+		{"0 0 31 * *", "2021-02-01 00:00", "2021-03-31 00:00"},
+		{"0 0 29 2 *", "2021-01-01 00:00", "2024-02-29 00:00"},
+		{"0 0 30 2 *", "2021-01-01 00:00", ""},
+
+		// Day of month or day of week.
+		{"0 12 13 * 5", "2021-01-01 12:00", "2021-01-08 12:00"},
+		{"0 12 13 * 5", "2021-01-08 12:00", "2021-01-13 12:00"},
+		{"0 12 13 * 5", "2021-01-13 12:00", "2021-01-15 12:00"},
+
+		// Aliases.
+		{"@hourly", "2021-01-01 10:00", "2021-01-01 11:00"},
+		{"@daily", "2021-01-01 10:00", "2021-01-02 00:00"},
+		{"@midnight", "2021-12-31 23:59", "2022-01-01 00:00"},
+		{"@weekly", "2021-01-01 10:00", "2021-01-03 00:00"},
+		{"@monthly", "2021-01-31 10:00", "2021-02-01 00:00"},
+		{"@yearly", "2021-01-01 00:00", "2022-01-01 00:00"},
+		{"@annually", "2021-06-01 00:00", "2022-01-01 00:00"},
+
+		{"@every 90m", "2021-01-01 10:07", "2021-01-01 11:37"},
+		{"@every 24h", "2021-12-31 23:59", "2022-01-01 23:59"},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want time.Time
+		if tt.want != "" {
+			want = parseTime(t, tt.want, time.UTC)
+		}
+		got := s.Next(parseTime(t, tt.from, time.UTC))
+		if !got.Equal(want) {
+			t.Errorf("%q after %s: got %s, want %s", tt.schedule, tt.from, got, want)
+		}
+	}
+}
+
+func TestScheduleNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// On 2021-03-14 clocks go from 2:00 EST to 3:00 EDT,
+	// and on 2021-11-07 from 2:00 EDT back to 1:00 EST.
+	tests := []struct {
+		schedule, from string
+		want           []string // in UTC
+	}{
+		// Skipped time runs once after the change.
+		{"30 2 * * *", "2021-03-13 12:00", []string{
+			"2021-03-14 07:30", // 3:30 EDT
+			"2021-03-15 06:30",
+		}},
+		{"@hourly", "2021-03-14 00:30", []string{
+			"2021-03-14 06:00", // 1:00 EST
+			"2021-03-14 07:00", // 3:00 EDT
+			"2021-03-14 08:00",
+		}},
+		// Repeated time runs once.
+		{"30 1 * * *", "2021-11-06 12:00", []string{
+			"2021-11-07 05:30", // 1:30 EDT
+			"2021-11-08 06:30",
+		}},
+		{"@hourly", "2021-11-07 00:30", []string{
+			"2021-11-07 05:00", // 1:00 EDT
+			"2021-11-07 07:00", // 2:00 EST
+		}},
+		{"@daily", "2021-11-06 12:00", []string{
+			"2021-11-07 04:00",
+			"2021-11-08 05:00",
+		}},
+		{"@every 1h", "2021-11-07 00:30", []string{
+			"2021-11-07 05:30",
+			"2021-11-07 06:30",
+			"2021-11-07 07:30",
+		}},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm := parseTime(t, tt.from, loc)
+		for _, w := range tt.want {
+			next := s.Next(tm)
+			if want := parseTime(t, w, time.UTC); !next.Equal(want) {
+				t.Errorf("%q after %s: got %s, want %s", tt.schedule, tm, next, want.In(loc))
+				break
+			}
+			tm = next
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"@often",
+		"@every",
+		"@every 30s",
+		"@every day",
+	}
+	for _, s := range bad {
+		if _, err := ParseSchedule(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
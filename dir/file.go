@@ -1,16 +1,21 @@
 package dir
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dchest/hesfic/block"
 	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/progress"
 )
 
 type Entry struct {
@@ -19,23 +24,183 @@ type Entry struct {
 	ModTime time.Time
 	Mode    os.FileMode
 	Ref     *block.Ref
+	Link    string `json:",omitempty"` // target of symbolic link
+	Owner   *Owner `json:",omitempty"`
+
+	// Inconsistent is true if file was changed while being read
+	// every time it was tried, so its content may be inconsistent.
+	Inconsistent bool `json:",omitempty"`
 }
 
-// Save stores file from disk at the given path and returns its metadata.
-func saveFile(path string) (entry *Entry, err error) {
-	fi, err := os.Stat(path)
-	if err != nil {
-		return
+// Owner describes owner of file.
+type Owner struct {
+	Uid   int
+	Gid   int
+	User  string `json:",omitempty"`
+	Group string `json:",omitempty"`
+}
+
+// IsSymlink returns true if entry is a symbolic link.
+func (e *Entry) IsSymlink() bool {
+	return e.Mode&os.ModeSymlink != 0
+}
+
+// Stats contains statistics about saved files.
+type Stats struct {
+	Files    int64      // number of saved files
+	Bytes    int64      // total size of saved files
+	NewBytes int64      // size of newly stored blocks
+	Skipped  []*Skipped // files skipped because of errors
+	Changed  []string   // paths of files which changed while being read
+}
+
+// Skipped describes file which was skipped because it couldn't be read.
+type Skipped struct {
+	Path  string
+	Error string
+}
+
+// sourceError is an error reading source file or directory,
+// as opposed to an error storing blocks.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string { return e.err.Error() }
+
+// sourceReader wraps errors returned by r into sourceError.
+type sourceReader struct {
+	r io.Reader
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &sourceError{err}
+	}
+	return n, err
+}
+
+// skipError returns true if err is an error reading source file at path,
+// which must be skipped according to config.OnError, recording it in stats.
+func skipError(path string, err error, stats *Stats) bool {
+	if _, ok := err.(*sourceError); !ok || config.OnError != config.OnErrorSkip {
+		return false
 	}
+	log.Printf("skipped %s: %s", path, err)
+	stats.Skipped = append(stats.Skipped, &Skipped{Path: path, Error: err.Error()})
+	return true
+}
+
+// saveFile stores file from disk at the given path and returns its
+// metadata. If file changes while being read, reading is retried up to
+// config.ChangedFileRetries times; if it still changes, the last read
+// content is stored and entry is marked as inconsistent. Blocks newly
+// stored by discarded reads are counted in stats only if entry uses them;
+// others are removed by garbage collection.
+func saveFile(path string, stats *Stats) (entry *Entry, err error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return
+		return nil, &sourceError{err}
 	}
 	defer f.Close()
 
+	newBlocks := make(map[block.Ref]int64) // stored by all reads
+	try := 0
+	for ; ; try++ {
+		var changed bool
+		var stored map[block.Ref]int64
+		entry, stored, changed, err = readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for ref, size := range stored {
+			newBlocks[ref] = size
+		}
+		if !changed {
+			break
+		}
+		if try >= config.ChangedFileRetries {
+			log.Printf("file %s changed while reading, stored as inconsistent", path)
+			entry.Inconsistent = true
+			stats.Changed = append(stats.Changed, path)
+			break
+		}
+		log.Printf("file %s changed while reading, retrying", path)
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return nil, &sourceError{err}
+		}
+	}
+	var newBytes int64
+	if try == 0 {
+		// All new blocks are used.
+		for _, size := range newBlocks {
+			newBytes += size
+		}
+	} else if newBytes, err = usedBytes(entry.Ref, newBlocks); err != nil {
+		return nil, err
+	}
+	stats.Files++
+	stats.Bytes += entry.Size
+	stats.NewBytes += newBytes
+	progress.AddFile()
+	log.Printf("stored file %s", path)
+	return entry, nil
+}
+
+// readFile stores content of file f and returns its entry and newly stored
+// blocks. It also returns true if file was changed while being read, as
+// detected by its size and modification time before and after reading.
+func readFile(f *os.File) (entry *Entry, newBlocks map[block.Ref]int64, changed bool, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, false, &sourceError{err}
+	}
 	w := block.NewWriter()
-	_, err = io.Copy(w, f)
+	n, err := io.Copy(w, progress.NewReader(&sourceReader{f}))
+	if err != nil {
+		return
+	}
+	ref, err := w.Finish()
+	if err != nil {
+		return
+	}
+	after, err := f.Stat()
+	if err != nil {
+		return nil, nil, false, &sourceError{err}
+	}
+	changed = n != fi.Size() || after.Size() != fi.Size() || !after.ModTime().Equal(fi.ModTime())
+	entry = &Entry{
+		Name:    fi.Name(),
+		Size:    n,
+		ModTime: after.ModTime(),
+		Mode:    fi.Mode(),
+		Ref:     ref,
+		Owner:   fileOwner(fi),
+	}
+	return entry, w.NewBlocks(), changed, nil
+}
+
+// usedBytes returns total size of blocks from newBlocks
+// used by content with the given ref.
+func usedBytes(ref *block.Ref, newBlocks map[block.Ref]int64) (n int64, err error) {
+	err = block.WalkRefs(ref, func(r *block.Ref) error {
+		n += newBlocks[*r]
+		delete(newBlocks, *r) // count each block once
+		return nil
+	})
+	return
+}
+
+// saveSymlink stores symbolic link at the given path and returns its
+// metadata. Link target is stored both in entry and as its content.
+func saveSymlink(path string, fi os.FileInfo, stats *Stats) (entry *Entry, err error) {
+	target, err := os.Readlink(path)
 	if err != nil {
+		return nil, &sourceError{err}
+	}
+	w := block.NewWriter()
+	if _, err = w.Write([]byte(target)); err != nil {
 		return
 	}
 	ref, err := w.Finish()
@@ -44,107 +209,423 @@ func saveFile(path string) (entry *Entry, err error) {
 	}
 	entry = &Entry{
 		Name:    fi.Name(),
-		Size:    fi.Size(),
+		Size:    int64(len(target)),
 		ModTime: fi.ModTime(),
 		Mode:    fi.Mode(),
 		Ref:     ref,
+		Link:    target,
+		Owner:   fileOwner(fi),
 	}
-	log.Printf("[%d] stored file %s", w.BlockCount(), path)
+	stats.Files++
+	stats.NewBytes += w.NewBytes()
+	progress.AddFile()
+	log.Printf("stored symlink %s", path)
 	return
 }
 
-func SaveDirectory(dirpath string) (entry *Entry, err error) {
-	fi, err := os.Stat(dirpath)
+// Scan returns the number of files and their total size in the given
+// paths and their subdirectories. Unreadable files are skipped. Scanning
+// stops early when cancel is closed.
+func Scan(paths []string, cancel <-chan struct{}) (files, bytes int64) {
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			select {
+			case <-cancel:
+				return errScanCancelled
+			default:
+			}
+			if err == nil && path != p && isExcluded(path, fi.Name()) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if err == nil && !fi.IsDir() {
+				files++
+				if fi.Mode().IsRegular() {
+					bytes += fi.Size()
+				}
+			}
+			return nil
+		})
+		if err == errScanCancelled {
+			return
+		}
+	}
+	return
+}
+
+var errScanCancelled = errors.New("scan cancelled")
+
+// isExcluded returns true if file with the given path and name
+// matches any of config.Exclude patterns.
+func isExcluded(path, name string) bool {
+	for _, pattern := range config.Exclude {
+		target := name
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				continue
+			}
+			target = abs
+		}
+		if ok, _ := filepath.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveReader stores content read from r until EOF as a file
+// with the given name and returns its metadata.
+func SaveReader(name string, r io.Reader, stats *Stats) (entry *Entry, err error) {
+	w := block.NewWriter()
+	n, err := io.Copy(w, progress.NewReader(r))
 	if err != nil {
 		return
 	}
-	dir, err := os.Open(dirpath)
+	ref, err := w.Finish()
 	if err != nil {
 		return
 	}
-	defer dir.Close()
-	fis, err := dir.Readdir(0)
+	entry = &Entry{
+		Name:    name,
+		Size:    n,
+		ModTime: time.Now(),
+		Mode:    0600,
+		Ref:     ref,
+	}
+	stats.Files++
+	stats.Bytes += n
+	stats.NewBytes += w.NewBytes()
+	progress.AddFile()
+	log.Printf("[%d] stored %s from stream", w.BlockCount(), name)
+	return
+}
+
+// SavePath stores file or directory from disk at the given path
+// and returns its metadata. Statistics are added to stats.
+func SavePath(path string, stats *Stats) (entry *Entry, err error) {
+	fi, err := os.Stat(path)
 	if err != nil {
 		return
 	}
-	entries := make([]*Entry, 0)
+	switch {
+	case fi.IsDir():
+		return SaveDirectory(path, stats)
+	case fi.Mode().IsRegular():
+		return saveFile(path, stats)
+	}
+	return nil, fmt.Errorf("%s is not a regular file or directory", path)
+}
+
+// SaveDirectory stores directory from disk at the given path
+// and returns its metadata. Statistics are added to stats.
+//
+// Files and subdirectories that cannot be read are skipped and recorded
+// in stats if config.OnError is OnErrorSkip.
+func SaveDirectory(dirpath string, stats *Stats) (entry *Entry, err error) {
+	fi, err := os.Stat(dirpath)
+	if err != nil {
+		return nil, &sourceError{err}
+	}
+	// Only names are kept in memory, entries are
+	// written one by one in the order of names.
+	dir, err := os.Open(dirpath)
+	if err != nil {
+		return nil, &sourceError{err}
+	}
+	names, err := dir.Readdirnames(0)
+	dir.Close()
+	if err != nil {
+		return nil, &sourceError{err}
+	}
+	sort.Strings(names)
+	w := NewWriter()
 	// Save files and subdirectories.
-	for _, fi := range fis {
-		fullpath := filepath.Join(dirpath, fi.Name())
+	for _, name := range names {
+		fullpath := filepath.Join(dirpath, name)
+		if isExcluded(fullpath, name) {
+			log.Printf("excluded %s", fullpath)
+			continue
+		}
+		var fi os.FileInfo
+		fi, err = os.Lstat(fullpath)
+		if err != nil {
+			err = &sourceError{err}
+			if skipError(fullpath, err, stats) {
+				continue
+			}
+			return
+		}
 		var e *Entry
-		if fi.IsDir() {
-			e, err = SaveDirectory(fullpath)
-		} else {
-			e, err = saveFile(fullpath)
+		switch {
+		case fi.IsDir():
+			e, err = SaveDirectory(fullpath, stats)
+		case fi.Mode()&os.ModeSymlink != 0:
+			e, err = saveSymlink(fullpath, fi, stats)
+		default:
+			e, err = saveFile(fullpath, stats)
 		}
 		if err != nil {
+			if skipError(fullpath, err, stats) {
+				continue
+			}
+			return
+		}
+		if err = w.Add(e); err != nil {
 			return
 		}
-		entries = append(entries, e)
 	}
 	// Save directory index.
-	w := block.NewWriter()
-	enc := json.NewEncoder(w)
-	err = enc.Encode(entries)
+	ref, newBytes, err := w.Finish()
 	if err != nil {
 		return
 	}
-	ref, err := w.Finish()
-	if err != nil {
-		return
-	}
-	log.Printf("[%d] stored directory %s at %s", w.BlockCount(), dirpath, ref)
+	stats.NewBytes += newBytes
+	log.Printf("stored directory %s at %s", dirpath, ref)
 	entry = &Entry{
 		Name:    fi.Name(),
 		Size:    fi.Size(),
 		ModTime: fi.ModTime(),
 		Mode:    fi.Mode(),
 		Ref:     ref,
+		Owner:   fileOwner(fi),
 	}
 	return
 }
 
+type entriesByName []*Entry
+
+func (p entriesByName) Len() int           { return len(p) }
+func (p entriesByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p entriesByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// SaveEntries stores directory with the given entries and returns
+// its ref and size of newly stored blocks.
+func SaveEntries(entries []*Entry) (ref *block.Ref, newBytes int64, err error) {
+	sorted := make([]*Entry, len(entries))
+	copy(sorted, entries)
+	sort.Sort(entriesByName(sorted))
+	w := NewWriter()
+	for _, e := range sorted {
+		if err = w.Add(e); err != nil {
+			return
+		}
+	}
+	return w.Finish()
+}
+
+// LoadDirectory returns all entries of directory with the given ref.
+// To avoid keeping entries of large directories in memory, use Reader.
 func LoadDirectory(ref *block.Ref) (entries []*Entry, err error) {
-	r, err := block.NewReader(ref)
+	r, err := NewReader(ref)
 	if err != nil {
 		return
 	}
-	err = json.NewDecoder(r).Decode(&entries)
-	return
+	entries = make([]*Entry, 0)
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
 }
 
-func restoreFile(entry *Entry, outdir string) error {
-	var path = filepath.Join(outdir, entry.Name)
-	if entry.Mode.IsDir() {
-		if err := os.MkdirAll(path, entry.Mode); err != nil {
-			return err
+// isRestored returns true if the file at path has the same size and
+// content as entry.
+func isRestored(path string, entry *Entry) bool {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != entry.Size {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	ref, err := block.ComputeRef(f)
+	if err != nil {
+		return false
+	}
+	return ref.Equal(entry.Ref)
+}
+
+// Prefix of names of temporary files created during restore,
+// which is followed by random digits.
+const restoreTempPrefix = ".hesfic-restore-"
+
+// isRestoreTemp returns true if name is in the format
+// of temporary files created during restore.
+func isRestoreTemp(name string) bool {
+	if !strings.HasPrefix(name, restoreTempPrefix) || len(name) == len(restoreTempPrefix) {
+		return false
+	}
+	for _, c := range name[len(restoreTempPrefix):] {
+		if c < '0' || c > '9' {
+			return false
 		}
-	} else {
-		r, err := block.NewReader(entry.Ref)
-		if err != nil {
-			return err
+	}
+	return true
+}
+
+// removeRestoreTemps removes temporary files left in outdir by an
+// interrupted restore of directory with the given ref. Entries of
+// the directory, which happen to have such names, are kept.
+func removeRestoreTemps(ref *block.Ref, outdir string) error {
+	f, err := os.Open(outdir)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	var r *Reader
+	for _, name := range names {
+		if !isRestoreTemp(name) {
+			continue
+		}
+		if r == nil {
+			if r, err = NewReader(ref); err != nil {
+				return err
+			}
 		}
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, entry.Mode)
+		e, err := r.Find(name)
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(f, r); err != nil {
-			f.Close()
-			os.Remove(path)
-			return err
+		if e != nil {
+			continue
 		}
-		if config.FileSync {
-			if err := f.Sync(); err != nil {
-				f.Close()
-				os.Remove(path)
-				return err
-			}
+		path := filepath.Join(outdir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
 		}
-		if err := f.Close(); err != nil {
-			os.Remove(path)
+		log.Printf("removed stale %s", path)
+	}
+	return nil
+}
+
+// tempName returns a new unique name for temporary file in dir.
+func tempName(dir string) (string, error) {
+	f, err := ioutil.TempFile(dir, restoreTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// permBits returns permission bits of mode including setuid,
+// setgid and sticky bits.
+func permBits(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// restoreSymlink creates symbolic link described by entry in outdir,
+// replacing existing file, if any. Modification time is not restored.
+func restoreSymlink(entry *Entry, outdir string) error {
+	var path = filepath.Join(outdir, entry.Name)
+	progress.AddFile()
+	if target, err := os.Readlink(path); err == nil && target == entry.Link {
+		log.Printf("skipped %s", path)
+		return nil
+	}
+	tmpPath, err := tempName(outdir)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(entry.Link, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	log.Printf("restored %s", path)
+	return nil
+}
+
+func restoreFile(entry *Entry, outdir string) error {
+	if entry.IsSymlink() {
+		return restoreSymlink(entry, outdir)
+	}
+	var path = filepath.Join(outdir, entry.Name)
+	if isRestored(path, entry) {
+		progress.AddFile()
+		progress.AddBytes(entry.Size)
+		log.Printf("skipped %s", path)
+		return nil
+	}
+	r, err := block.NewReader(entry.Ref)
+	if err != nil {
+		return err
+	}
+	// Write into a temporary file, which is renamed when complete,
+	// so that interrupted restore never leaves partial files.
+	f, err := ioutil.TempFile(outdir, restoreTempPrefix)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := io.Copy(f, progress.NewReader(r)); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if config.FileSync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
 			return err
 		}
 	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// Set mode after writing, since writing may clear setuid and setgid bits.
+	if err := os.Chmod(tmpPath, permBits(entry.Mode)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chtimes(tmpPath, time.Now(), entry.ModTime); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	progress.AddFile()
+	log.Printf("restored %s", path)
+	return nil
+}
+
+// makeDir creates directory at path writable by us, so that its
+// contents can be restored. Its real mode is set by finishDir.
+func makeDir(path string) error {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	// Directory may already exist from an interrupted restore.
+	return os.Chmod(path, 0700)
+}
+
+// finishDir sets mode and modification time of the restored directory.
+func finishDir(entry *Entry, path string) error {
+	if err := os.Chmod(path, permBits(entry.Mode)); err != nil {
+		return err
+	}
 	if err := os.Chtimes(path, time.Now(), entry.ModTime); err != nil {
 		return err
 	}
@@ -152,41 +633,186 @@ func restoreFile(entry *Entry, outdir string) error {
 	return nil
 }
 
-func RestoreDirectory(ref *block.Ref, outdir string) error {
+type restoredDir struct {
+	entry *Entry
+	path  string
+}
+
+type restoreJob struct {
+	entry  *Entry
+	outdir string
+}
+
+// restorer restores files using a pool of workers.
+type restorer struct {
+	files chan restoreJob
+	wg    sync.WaitGroup
+
+	mu  sync.Mutex
+	err error // first error encountered by workers
+
+	dirs []restoredDir // directories in the order of creation
+}
+
+func newRestorer(workers int) *restorer {
+	rs := &restorer{files: make(chan restoreJob)}
+	for i := 0; i < workers; i++ {
+		rs.wg.Add(1)
+		go rs.work()
+	}
+	return rs
+}
+
+func (rs *restorer) work() {
+	defer rs.wg.Done()
+	for job := range rs.files {
+		if rs.error() != nil {
+			continue // drain remaining jobs
+		}
+		if err := restoreFile(job.entry, job.outdir); err != nil {
+			rs.setError(err)
+		}
+	}
+}
+
+func (rs *restorer) error() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.err
+}
+
+func (rs *restorer) setError(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.err == nil {
+		rs.err = err
+	}
+}
+
+// wait waits for workers to finish restoring queued files
+// and returns the first error they encountered.
+func (rs *restorer) wait() error {
+	close(rs.files)
+	rs.wg.Wait()
+	return rs.err
+}
+
+func (rs *restorer) restoreDirectory(ref *block.Ref, outdir string) error {
 	if err := os.MkdirAll(outdir, 0755); err != nil {
 		return err
 	}
-	entries, err := LoadDirectory(ref)
+	if err := removeRestoreTemps(ref, outdir); err != nil {
+		return err
+	}
+	r, err := NewReader(ref)
 	if err != nil {
 		return err
 	}
-	for _, e := range entries {
-		if err := restoreFile(e, outdir); err != nil {
+	// Subdirectories are restored after reading all entries,
+	// so that only one directory is read at a time.
+	var subdirs []restoredDir
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := rs.error(); err != nil {
+			return err
+		}
+		if !e.Mode.IsDir() {
+			rs.files <- restoreJob{e, outdir}
+			continue
+		}
+		path := filepath.Join(outdir, e.Name)
+		if err := makeDir(path); err != nil {
+			return err
+		}
+		subdirs = append(subdirs, restoredDir{e, path})
+	}
+	for _, d := range subdirs {
+		rs.dirs = append(rs.dirs, d)
+		if err := rs.restoreDirectory(d.entry.Ref, d.path); err != nil {
 			return err
 		}
-		if e.Mode.IsDir() {
-			if err := RestoreDirectory(e.Ref, filepath.Join(outdir, e.Name)); err != nil {
-				return err
-			}
+	}
+	return nil
+}
+
+// finishDirs sets modes and times of restored directories, children
+// first, so that they are not changed by restoring their contents.
+func (rs *restorer) finishDirs() error {
+	for i := len(rs.dirs) - 1; i >= 0; i-- {
+		d := rs.dirs[i]
+		if err := finishDir(d.entry, d.path); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// RestoreEntry restores file or directory described by entry into outdir
+// using the given number of concurrent workers (see RestoreDirectory).
+// Directory contents are restored into outdir itself.
+func RestoreEntry(entry *Entry, outdir string, workers int) error {
+	if entry.Mode.IsDir() {
+		return RestoreDirectory(entry.Ref, outdir, workers)
+	}
+	if err := os.MkdirAll(outdir, 0755); err != nil {
+		return err
+	}
+	return restoreFile(entry, outdir)
+}
+
+// RestoreDirectory restores directory with the given ref into outdir
+// using the given number of concurrent workers to restore files.
+//
+// Files that already exist in outdir and have the same size and content
+// are skipped, so an interrupted restore can be resumed. Modes and
+// modification times of directories are set after all files are restored.
+func RestoreDirectory(ref *block.Ref, outdir string, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	rs := newRestorer(workers)
+	err := rs.restoreDirectory(ref, outdir)
+	if werr := rs.wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	return rs.finishDirs()
+}
+
 func walkDirectory(ref *block.Ref, basePath string, callback func(path string, entry *Entry) error) error {
-	entries, err := LoadDirectory(ref)
+	r, err := NewReader(ref)
 	if err != nil {
 		return err
 	}
-	for _, e := range entries {
-		path := filepath.Join(basePath, e.Name)
-		if err := callback(path, e); err != nil {
+	// Subdirectories are walked after reading all entries,
+	// so that only one directory is read at a time.
+	var subdirs []*Entry
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := callback(filepath.Join(basePath, e.Name), e); err != nil {
 			return err
 		}
 		if e.Mode.IsDir() {
-			if err := walkDirectory(e.Ref, path, callback); err != nil {
-				return err
-			}
+			subdirs = append(subdirs, e)
+		}
+	}
+	for _, e := range subdirs {
+		if err := walkDirectory(e.Ref, filepath.Join(basePath, e.Name), callback); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -196,17 +822,58 @@ func Walk(ref *block.Ref, callback func(path string, entry *Entry) error) error
 	return walkDirectory(ref, "", callback)
 }
 
+// Lookup returns entry at the slash-separated path relative
+// to the directory with the given ref.
+func Lookup(ref *block.Ref, path string) (*Entry, error) {
+	var entry *Entry
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if entry != nil {
+			if !entry.Mode.IsDir() {
+				return nil, fmt.Errorf("%s is not a directory", entry.Name)
+			}
+			ref = entry.Ref
+		}
+		r, err := NewReader(ref)
+		if err != nil {
+			return nil, err
+		}
+		entry, err = r.Find(name)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("%s not found", name)
+		}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("empty path")
+	}
+	return entry, nil
+}
+
 func verifyFile(entry *Entry) error {
 	r, err := block.NewReader(entry.Ref)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+	if _, err := io.Copy(ioutil.Discard, progress.NewReader(r)); err != nil {
 		return err
 	}
+	progress.AddFile()
 	return nil
 }
 
+// VerifyEntry verifies file or directory described by entry.
+func VerifyEntry(entry *Entry) error {
+	if entry.Mode.IsDir() {
+		return VerifyDirectory(entry.Ref)
+	}
+	return verifyFile(entry)
+}
+
 func VerifyDirectory(ref *block.Ref) error {
 	return Walk(ref, func(path string, entry *Entry) error {
 		if entry.Mode.IsDir() {
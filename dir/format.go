@@ -0,0 +1,306 @@
+package dir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/config"
+)
+
+// Directory format
+//
+// Directory is stored as:
+//
+//	magic || records || 0 || index || footer
+//
+// Each record is uvarint length followed by JSON-encoded entry with
+// modification time in UTC. Records are sorted by entry name, so that
+// identical directories always have identical refs. Index contains uvarint
+// number of index items, and for every indexInterval'th record, the name
+// and the offset of record from the beginning of directory (each as uvarint
+// length-prefixed name and uvarint offset). Footer is big-endian 8-byte
+// offset of index and 8-byte number of records.
+//
+// Directories stored by older versions are JSON arrays of entries.
+
+var dirMagic = []byte("HESFICDIR2\n")
+
+const (
+	indexInterval = 128     // number of records per index item
+	footerSize    = 8 + 8   // size of footer
+	maxRecordSize = 1 << 20 // maximum size of record or name in index
+)
+
+type indexItem struct {
+	name   string
+	offset int64
+}
+
+// Writer writes directory entries, which must be added in the order
+// of their names, without keeping them in memory.
+type Writer struct {
+	w        *block.Writer // created when buf grows larger than block
+	buf      bytes.Buffer
+	offset   int64
+	count    int64
+	lastName string
+	index    []indexItem
+}
+
+// NewWriter returns a new directory writer.
+func NewWriter() *Writer {
+	w := new(Writer)
+	w.buf.Write(dirMagic)
+	w.offset = int64(len(dirMagic))
+	return w
+}
+
+func (w *Writer) write(b []byte) error {
+	w.buf.Write(b)
+	w.offset += int64(len(b))
+	if w.buf.Len() < config.BlockSize {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	if w.w == nil {
+		w.w = block.NewWriter()
+	}
+	if _, err := w.w.Write(w.buf.Bytes()); err != nil {
+		return err
+	}
+	w.buf.Reset()
+	return nil
+}
+
+func (w *Writer) writeUvarint(x uint64) error {
+	var tmp [binary.MaxVarintLen64]byte
+	return w.write(tmp[:binary.PutUvarint(tmp[:], x)])
+}
+
+// Add adds entry to directory. Entries must be added
+// in increasing order of their names.
+func (w *Writer) Add(e *Entry) error {
+	if w.count > 0 && e.Name <= w.lastName {
+		return fmt.Errorf("directory entry %q added after %q", e.Name, w.lastName)
+	}
+	// Normalize time zone, so that the same
+	// entries are always encoded the same way.
+	ne := *e
+	ne.ModTime = e.ModTime.UTC()
+	data, err := json.Marshal(&ne)
+	if err != nil {
+		return err
+	}
+	if w.count%indexInterval == 0 {
+		w.index = append(w.index, indexItem{e.Name, w.offset})
+	}
+	w.count++
+	w.lastName = e.Name
+	if err := w.writeUvarint(uint64(len(data))); err != nil {
+		return err
+	}
+	return w.write(data)
+}
+
+// Finish writes index and stores directory. It returns ref
+// of directory and size of newly stored blocks.
+func (w *Writer) Finish() (ref *block.Ref, newBytes int64, err error) {
+	if err = w.writeUvarint(0); err != nil {
+		return
+	}
+	indexOffset := w.offset
+	if err = w.writeUvarint(uint64(len(w.index))); err != nil {
+		return
+	}
+	for _, item := range w.index {
+		if err = w.writeUvarint(uint64(len(item.name))); err != nil {
+			return
+		}
+		if err = w.write([]byte(item.name)); err != nil {
+			return
+		}
+		if err = w.writeUvarint(uint64(item.offset)); err != nil {
+			return
+		}
+	}
+	var footer [footerSize]byte
+	binary.BigEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(w.count))
+	if err = w.write(footer[:]); err != nil {
+		return
+	}
+	if err = w.flush(); err != nil {
+		return
+	}
+	ref, err = w.w.Finish()
+	if err != nil {
+		return
+	}
+	return ref, w.w.NewBytes(), nil
+}
+
+// Reader reads directory entries.
+type Reader struct {
+	br     *block.Reader
+	r      *bufio.Reader
+	legacy []*Entry // entries of directory in old format
+	isOld  bool
+	done   bool
+}
+
+// NewReader returns a reader of directory with the given ref.
+func NewReader(ref *block.Ref) (*Reader, error) {
+	br, err := block.NewReader(ref)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{br: br, r: bufio.NewReader(br)}
+	magic, err := r.r.Peek(len(dirMagic))
+	if err == nil && bytes.Equal(magic, dirMagic) {
+		r.r.Discard(len(dirMagic))
+		return r, nil
+	}
+	// Old format.
+	r.isOld = true
+	if err := json.NewDecoder(r.r).Decode(&r.legacy); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Next returns the next entry of directory or io.EOF if there are no more
+// entries. Entries of directories in the current format are returned in
+// order of their names.
+func (r *Reader) Next() (*Entry, error) {
+	if r.isOld {
+		if len(r.legacy) == 0 {
+			return nil, io.EOF
+		}
+		e := r.legacy[0]
+		r.legacy = r.legacy[1:]
+		return e, nil
+	}
+	if r.done {
+		return nil, io.EOF
+	}
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if n == 0 {
+		r.done = true
+		return nil, io.EOF
+	}
+	if n > maxRecordSize {
+		return nil, fmt.Errorf("directory record is too large")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	e := new(Entry)
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readIndex reads directory index.
+func (r *Reader) readIndex() ([]indexItem, error) {
+	if _, err := r.br.Seek(-footerSize, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	var footer [footerSize]byte
+	if _, err := io.ReadFull(r.br, footer[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer[0:8]))
+	if _, err := r.br.Seek(indexOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r.r.Reset(r.br)
+	count, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	var index []indexItem
+	for i := uint64(0); i < count; i++ {
+		n, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if n > maxRecordSize {
+			return nil, fmt.Errorf("directory index is corrupted")
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r.r, name); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		offset, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		index = append(index, indexItem{string(name), int64(offset)})
+	}
+	return index, nil
+}
+
+// Find returns entry with the given name or nil if there's no such entry.
+// For directories in the current format, it uses binary search and reads
+// only blocks with index and the needed records. Find changes position of
+// reader, so Next must not be used after it.
+func (r *Reader) Find(name string) (*Entry, error) {
+	if r.isOld {
+		for _, e := range r.legacy {
+			if e.Name == name {
+				return e, nil
+			}
+		}
+		return nil, nil
+	}
+	index, err := r.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(index), func(i int) bool { return index[i].name > name }) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	if _, err := r.br.Seek(index[i].offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r.r.Reset(r.br)
+	r.done = false
+	for j := 0; j < indexInterval; j++ {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.Name == name {
+			return e, nil
+		}
+		if e.Name > name {
+			break
+		}
+	}
+	return nil, nil
+}
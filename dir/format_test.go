@@ -0,0 +1,235 @@
+package dir
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/internal/testrepo"
+)
+
+func TestStableRefs(t *testing.T) {
+	defer testrepo.Use(t)()
+	rnd := rand.New(rand.NewSource(1))
+
+	// Enough entries for several index items and blocks.
+	const n = 1000
+	base := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	entries := make([]*Entry, n)
+	for i := range entries {
+		var ref block.Ref
+		rnd.Read(ref[:])
+		entries[i] = &Entry{
+			Name:    fmt.Sprintf("file-%d-%x", i, ref[:4]),
+			Size:    rnd.Int63n(1 << 30),
+			ModTime: base.Add(time.Duration(rnd.Int63n(int64(1000 * time.Hour)))),
+			Mode:    0644,
+			Ref:     &ref,
+		}
+	}
+	want, _, err := SaveEntries(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		// Same entries in different order with times in different zones.
+		shuffled := make([]*Entry, n)
+		for j, k := range rnd.Perm(n) {
+			e := *entries[k]
+			zone := time.FixedZone(fmt.Sprintf("Z%d", j), (rnd.Intn(26*4)-12*4)*15*60)
+			e.ModTime = e.ModTime.In(zone)
+			shuffled[j] = &e
+		}
+		ref, _, err := SaveEntries(shuffled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ref.Equal(want) {
+			t.Fatalf("%d: ref %s differs from %s", i, ref, want)
+		}
+	}
+
+	// Entries are read back in order of names with the same times.
+	loaded, err := LoadDirectory(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != n {
+		t.Fatalf("loaded %d entries, want %d", len(loaded), n)
+	}
+	modTimes := make(map[string]time.Time)
+	for _, e := range entries {
+		modTimes[e.Name] = e.ModTime
+	}
+	for i, e := range loaded {
+		if i > 0 && loaded[i-1].Name >= e.Name {
+			t.Fatalf("entries are not sorted: %s after %s", e.Name, loaded[i-1].Name)
+		}
+		if !e.ModTime.Equal(modTimes[e.Name]) {
+			t.Fatalf("%s: time %s, want %s", e.Name, e.ModTime, modTimes[e.Name])
+		}
+	}
+}
+
+// sortedEntries returns n entries with names in increasing order, leaving
+// gaps between them, so that there are missing names between any two.
+func sortedEntries(rnd *rand.Rand, n int) []*Entry {
+	entries := make([]*Entry, n)
+	for i := range entries {
+		var ref block.Ref
+		rnd.Read(ref[:])
+		entries[i] = &Entry{
+			Name:    fmt.Sprintf("file-%05d", 2*i+1),
+			Size:    rnd.Int63n(1 << 30),
+			ModTime: time.Unix(rnd.Int63n(1<<31), 0),
+			Mode:    0644,
+			Ref:     &ref,
+		}
+	}
+	return entries
+}
+
+// find looks up name with a new reader of directory.
+func find(t *testing.T, ref *block.Ref, name string) *Entry {
+	r, err := NewReader(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := r.Find(name)
+	if err != nil {
+		t.Fatalf("find %q: %s", name, err)
+	}
+	return e
+}
+
+// checkFind checks that entries at the ends, around index items and some
+// others are found, and that names before, after and between them are not.
+func checkFind(t *testing.T, ref *block.Ref, entries []*Entry) {
+	for i, want := range entries {
+		k := i % indexInterval
+		if i > 2 && i < len(entries)-3 && k > 1 && k < indexInterval-1 && i%11 != 0 {
+			continue
+		}
+		e := find(t, ref, want.Name)
+		if e == nil {
+			t.Fatalf("%d of %d: %s not found", i, len(entries), want.Name)
+		}
+		if e.Name != want.Name || e.Size != want.Size || !e.Ref.Equal(want.Ref) {
+			t.Fatalf("found %+v, want %+v", e, want)
+		}
+		missing := fmt.Sprintf("file-%05d", 2*i)
+		if e := find(t, ref, missing); e != nil {
+			t.Fatalf("%d of %d: found missing %s", i, len(entries), missing)
+		}
+	}
+	for _, name := range []string{"", "a", "file-", "file-99999", "z"} {
+		if e := find(t, ref, name); e != nil {
+			t.Fatalf("%d entries: found missing %q", len(entries), name)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	defer testrepo.Use(t)()
+	rnd := rand.New(rand.NewSource(2))
+	// Sizes around index interval, and large enough
+	// to have several index items and blocks.
+	for _, n := range []int{0, 1, 2, indexInterval - 1, indexInterval, indexInterval + 1, 2*indexInterval + 1, 1000} {
+		entries := sortedEntries(rnd, n)
+		w := NewWriter()
+		for _, e := range entries {
+			if err := w.Add(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ref, _, err := w.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFind(t, ref, entries)
+	}
+}
+
+func TestSeveralBlocks(t *testing.T) {
+	defer testrepo.Use(t)()
+	entries := sortedEntries(rand.New(rand.NewSource(3)), 2000)
+	ref, _, err := SaveEntries(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := 0
+	if err := block.WalkRefs(ref, func(*block.Ref) error { blocks++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// Pointer block and at least two data blocks.
+	if blocks < 3 {
+		t.Fatalf("directory is stored in %d blocks, want several", blocks)
+	}
+	loaded, err := LoadDirectory(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(entries) {
+		t.Fatalf("loaded %d entries, want %d", len(loaded), len(entries))
+	}
+	for i, e := range loaded {
+		if e.Name != entries[i].Name || !e.Ref.Equal(entries[i].Ref) {
+			t.Fatalf("entry %d is %s, want %s", i, e.Name, entries[i].Name)
+		}
+	}
+	checkFind(t, ref, entries)
+}
+
+func TestLegacyDirectory(t *testing.T) {
+	defer testrepo.Use(t)()
+	entries := sortedEntries(rand.New(rand.NewSource(4)), 300)
+	// Older versions didn't sort entries.
+	rand.New(rand.NewSource(5)).Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := block.NewWriter()
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := w.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDirectory(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(entries) {
+		t.Fatalf("loaded %d entries, want %d", len(loaded), len(entries))
+	}
+	for i, e := range loaded {
+		if e.Name != entries[i].Name || !e.ModTime.Equal(entries[i].ModTime) {
+			t.Fatalf("entry %d is %s, want %s", i, e.Name, entries[i].Name)
+		}
+	}
+	checkFind(t, ref, entries)
+}
+
+func TestWriterOrder(t *testing.T) {
+	defer testrepo.Use(t)()
+	w := NewWriter()
+	if err := w.Add(&Entry{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", ""} {
+		if err := w.Add(&Entry{Name: name}); err == nil {
+			t.Fatalf("added %q after %q", name, "b")
+		}
+	}
+	if err := w.Add(&Entry{Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package dir
+
+import "os"
+
+// fileOwner returns nil, since ownership is not supported on this system.
+func fileOwner(fi os.FileInfo) *Owner {
+	return nil
+}
@@ -0,0 +1,60 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package dir
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+var ownerNames struct {
+	sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+// lookupName returns name for id using lookup function,
+// caching results in the given map.
+func lookupName(cache *map[uint32]string, id uint32, lookup func(string) (string, error)) string {
+	ownerNames.Lock()
+	defer ownerNames.Unlock()
+	if *cache == nil {
+		*cache = make(map[uint32]string)
+	}
+	name, ok := (*cache)[id]
+	if !ok {
+		name, _ = lookup(strconv.FormatUint(uint64(id), 10))
+		(*cache)[id] = name
+	}
+	return name
+}
+
+// fileOwner returns owner of file described by fi.
+func fileOwner(fi os.FileInfo) *Owner {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &Owner{
+		Uid: int(st.Uid),
+		Gid: int(st.Gid),
+		User: lookupName(&ownerNames.users, st.Uid, func(id string) (string, error) {
+			u, err := user.LookupId(id)
+			if err != nil {
+				return "", err
+			}
+			return u.Username, nil
+		}),
+		Group: lookupName(&ownerNames.groups, st.Gid, func(id string) (string, error) {
+			g, err := user.LookupGroupId(id)
+			if err != nil {
+				return "", err
+			}
+			return g.Name, nil
+		}),
+	}
+}
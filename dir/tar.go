@@ -0,0 +1,236 @@
+package dir
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dchest/hesfic/block"
+)
+
+// tarMode returns tar header mode for the given file mode.
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// fileMode returns file mode for the given tar header.
+func fileMode(hdr *tar.Header) os.FileMode {
+	m := os.FileMode(hdr.Mode).Perm()
+	if hdr.Mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if hdr.Mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if hdr.Mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		m |= os.ModeDir
+	case tar.TypeSymlink:
+		m |= os.ModeSymlink
+	}
+	return m
+}
+
+func writeTarEntry(tw *tar.Writer, name string, e *Entry) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    tarMode(e.Mode),
+		ModTime: e.ModTime,
+	}
+	if e.Owner != nil {
+		hdr.Uid = e.Owner.Uid
+		hdr.Gid = e.Owner.Gid
+		hdr.Uname = e.Owner.User
+		hdr.Gname = e.Owner.Group
+	}
+	switch {
+	case e.Mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case e.IsSymlink():
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Link
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.Size
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	r, err := block.NewReader(e.Ref)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return err
+	}
+	if n != e.Size {
+		return fmt.Errorf("%s: size is %d, expected %d", name, n, e.Size)
+	}
+	return nil
+}
+
+// ExportTar writes file or directory described by entry to w as a tar
+// archive. Directory contents are written with paths relative to it.
+func ExportTar(w io.Writer, entry *Entry) error {
+	tw := tar.NewWriter(w)
+	var err error
+	if entry.Mode.IsDir() {
+		err = Walk(entry.Ref, func(p string, e *Entry) error {
+			return writeTarEntry(tw, filepath.ToSlash(p), e)
+		})
+	} else {
+		err = writeTarEntry(tw, entry.Name, entry)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// tarDir is a directory being imported from tar archive.
+type tarDir struct {
+	entry *Entry
+	files map[string]*Entry
+	dirs  map[string]*tarDir
+}
+
+func newTarDir(name string) *tarDir {
+	return &tarDir{
+		entry: &Entry{Name: name, ModTime: time.Now(), Mode: os.ModeDir | 0755},
+		files: make(map[string]*Entry),
+		dirs:  make(map[string]*tarDir),
+	}
+}
+
+// dir returns subdirectory at the given slash-separated path,
+// creating it and its parents if they don't exist.
+func (d *tarDir) dir(p string) *tarDir {
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		sub := d.dirs[name]
+		if sub == nil {
+			sub = newTarDir(name)
+			d.dirs[name] = sub
+			delete(d.files, name)
+		}
+		d = sub
+	}
+	return d
+}
+
+// save stores directory and its subdirectories.
+func (d *tarDir) save(stats *Stats) (*block.Ref, error) {
+	entries := make([]*Entry, 0, len(d.files)+len(d.dirs))
+	for _, sub := range d.dirs {
+		ref, err := sub.save(stats)
+		if err != nil {
+			return nil, err
+		}
+		sub.entry.Ref = ref
+		entries = append(entries, sub.entry)
+	}
+	for _, e := range d.files {
+		entries = append(entries, e)
+	}
+	ref, newBytes, err := SaveEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	stats.NewBytes += newBytes
+	return ref, nil
+}
+
+// ImportTar stores files from tar archive read from r and returns ref
+// of the root directory. Statistics are added to stats. Regular files,
+// directories, symbolic and hard links are imported; other entries,
+// such as devices, are skipped.
+func ImportTar(r io.Reader, stats *Stats) (*block.Ref, error) {
+	root := newTarDir("")
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := strings.Trim(path.Clean("/"+hdr.Name), "/")
+		if p == "" {
+			continue // root directory
+		}
+		dirPath, name := path.Split(p)
+		parent := root.dir(dirPath)
+		var owner *Owner
+		if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+			owner = &Owner{Uid: hdr.Uid, Gid: hdr.Gid, User: hdr.Uname, Group: hdr.Gname}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			d := parent.dir(name)
+			d.entry.ModTime = hdr.ModTime
+			d.entry.Mode = fileMode(hdr)
+			d.entry.Owner = owner
+		case tar.TypeReg, tar.TypeSymlink:
+			var e *Entry
+			if hdr.Typeflag == tar.TypeSymlink {
+				e, err = SaveReader(name, strings.NewReader(hdr.Linkname), stats)
+				if err == nil {
+					e.Link = hdr.Linkname
+					stats.Bytes -= e.Size
+				}
+			} else {
+				e, err = SaveReader(name, tr, stats)
+			}
+			if err != nil {
+				return nil, err
+			}
+			e.ModTime = hdr.ModTime
+			e.Mode = fileMode(hdr)
+			e.Owner = owner
+			delete(parent.dirs, name)
+			parent.files[name] = e
+		case tar.TypeLink:
+			target := strings.Trim(path.Clean("/"+hdr.Linkname), "/")
+			tdir, tname := path.Split(target)
+			te := root.dir(tdir).files[tname]
+			if te == nil {
+				return nil, fmt.Errorf("%s: hard link to unknown file %s", p, hdr.Linkname)
+			}
+			e := *te
+			e.Name = name
+			parent.files[name] = &e
+			stats.Files++
+			stats.Bytes += e.Size
+		default:
+			log.Printf("skipped %s: unsupported type %c", p, hdr.Typeflag)
+		}
+	}
+	return root.save(stats)
+}
@@ -0,0 +1,63 @@
+// Package hook runs commands defined in config before and after operations.
+package hook
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+
+	"github.com/dchest/hesfic/config"
+)
+
+// Run runs hooks defined for event in the order they are defined in config.
+// Each hook is run with the given environment variables in addition to the
+// current environment and HESFIC_EVENT set to event. Hook output goes to
+// standard error.
+//
+// If a hook fails, Run returns error without running the rest of hooks,
+// unless failure policy of hook is to warn or ignore.
+func Run(event string, env map[string]string) error {
+	for _, h := range config.Hooks {
+		if h.Event != event {
+			continue
+		}
+		log.Printf("running %s hook: %s", event, h.Command)
+		if err := command(h.Command, event, env).Run(); err != nil {
+			err = fmt.Errorf("%s hook %q failed: %s", event, h.Command, err)
+			switch h.OnFailure {
+			case config.HookIgnore:
+				log.Printf("%s", err)
+				continue
+			case config.HookWarn:
+				fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func command(s, event string, env map[string]string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", s)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", s)
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	cmd.Env = append(os.Environ(), "HESFIC_EVENT="+event)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+env[k])
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd
+}
@@ -0,0 +1,42 @@
+// Package testrepo creates temporary repositories for tests.
+package testrepo
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dchest/hesfic/config"
+)
+
+// BlockSize is the size of blocks in test repositories,
+// which is small, so that tests create many blocks.
+const BlockSize = 64 * 1024
+
+// Use switches current settings to a new temporary repository with random
+// keys, blocks of BlockSize, no parity and no verification of existing
+// blocks. It returns function, which removes the repository and switches
+// back to the previous settings.
+func Use(t testing.TB) func() {
+	dir, err := ioutil.TempDir("", "hesfic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config.Current()
+	config.SetOutPath(dir)
+	config.MakePaths()
+	config.BlockSize = BlockSize
+	config.ParityBlocks = 0
+	config.VerifyExistingBlocks = false
+	for _, key := range []*[32]byte{&config.Keys.RefHash, &config.Keys.BlockEnc, &config.Keys.SnapshotEnc} {
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		saved.Use()
+		os.RemoveAll(dir)
+	}
+}
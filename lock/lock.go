@@ -0,0 +1,296 @@
+// Package lock implements repository locks.
+//
+// Locks are stored as encrypted files in the "locks" subdirectory of the
+// output directory, so that processes on different machines sharing the
+// same output directory see each other's locks. Any number of processes
+// can hold shared locks at the same time, while an exclusive lock can only
+// be held by a single process when no other locks are held.
+//
+// Processes holding locks periodically update heartbeat time in their lock
+// files. Locks with old heartbeat time, or locks of processes that no
+// longer exist on this host, are considered stale and are ignored.
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/safefile"
+)
+
+var (
+	// Locks with heartbeat older than this are stale.
+	StaleTimeout = 30 * time.Minute
+
+	// Interval between heartbeat updates.
+	HeartbeatInterval = 5 * time.Minute
+)
+
+const namePrefix = "lock-"
+
+// Information about lock.
+type Info struct {
+	Exclusive bool
+	Username  string
+	Hostname  string
+	PID       int
+	Time      time.Time // when lock was acquired
+	Heartbeat time.Time // when lock was last refreshed
+}
+
+func (info *Info) String() string {
+	kind := "shared"
+	if info.Exclusive {
+		kind = "exclusive"
+	}
+	return fmt.Sprintf("%s lock by %s@%s (PID %d) since %s", kind, info.Username,
+		info.Hostname, info.PID, info.Time.Local().Format(time.RFC1123))
+}
+
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) != os.ErrProcessDone
+}
+
+// IsStale returns true if lock is stale.
+func (info *Info) IsStale() bool {
+	if time.Since(info.Heartbeat) > StaleTimeout {
+		return true
+	}
+	if hostname, _ := os.Hostname(); hostname == info.Hostname {
+		return !processExists(info.PID)
+	}
+	return false
+}
+
+func lockPath(name string) string {
+	return filepath.Join(config.LocksPath, name)
+}
+
+// store atomically writes lock info encrypted with
+// the given key into file at the given path.
+func (info *Info) store(path string, key *[32]byte) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	box := secretbox.Seal(nonce[:], data, &nonce, key)
+	return safefile.WriteFile(path, box, 0644)
+}
+
+func load(name string) (*Info, error) {
+	box, err := ioutil.ReadFile(lockPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if len(box) < 24 {
+		return nil, fmt.Errorf("lock %s is too short", name)
+	}
+	var nonce [24]byte
+	copy(nonce[:], box)
+	data, ok := secretbox.Open(nil, box[24:], &nonce, &config.Keys.SnapshotEnc)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt lock %s", name)
+	}
+	info := new(Info)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Listed is a lock found in the locks directory.
+type Listed struct {
+	Name string
+	Info *Info
+	Err  error // error loading lock info
+}
+
+// IsStale returns true if lock is stale. Unreadable locks
+// are stale if their files weren't modified for StaleTimeout.
+func (l *Listed) IsStale() bool {
+	if l.Err == nil {
+		return l.Info.IsStale()
+	}
+	fi, err := os.Stat(lockPath(l.Name))
+	return err == nil && time.Since(fi.ModTime()) > StaleTimeout
+}
+
+// List returns all locks.
+func List() ([]*Listed, error) {
+	fis, err := ioutil.ReadDir(config.LocksPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var locks []*Listed
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+		info, err := load(name)
+		if os.IsNotExist(err) {
+			continue // released while listing
+		}
+		locks = append(locks, &Listed{Name: name, Info: info, Err: err})
+	}
+	return locks, nil
+}
+
+// conflict returns error if any of locks, except the one with
+// the given name, conflicts with the requested lock.
+func conflict(exclusive bool, ownName string) error {
+	locks, err := List()
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if l.Name == ownName || l.IsStale() {
+			continue
+		}
+		if l.Err != nil {
+			return fmt.Errorf("repository is locked: %s", l.Err)
+		}
+		if exclusive || l.Info.Exclusive {
+			return fmt.Errorf("repository is locked: %s", l.Info)
+		}
+	}
+	return nil
+}
+
+// Lock is a lock held by this process.
+type Lock struct {
+	path string
+	key  [32]byte
+	info Info
+
+	stop     chan bool
+	stopped  sync.WaitGroup
+	released bool
+}
+
+// Acquire acquires shared or exclusive repository lock.
+// It returns error if repository is locked by another process
+// in a conflicting mode.
+func Acquire(exclusive bool) (*Lock, error) {
+	if err := os.MkdirAll(config.LocksPath, 0755); err != nil {
+		return nil, err
+	}
+	// Check before storing our lock, so that we don't disturb
+	// others with our lock if we can't get it anyway.
+	if err := conflict(exclusive, ""); err != nil {
+		return nil, err
+	}
+	var id [16]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	name := namePrefix + hex.EncodeToString(id[:])
+	l := &Lock{
+		path: lockPath(name),
+		key:  config.Keys.SnapshotEnc,
+		info: Info{
+			Exclusive: exclusive,
+			PID:       os.Getpid(),
+			Time:      now,
+			Heartbeat: now,
+		},
+		stop: make(chan bool),
+	}
+	l.info.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		l.info.Username = u.Username
+	}
+	if err := l.info.store(l.path, &l.key); err != nil {
+		return nil, err
+	}
+	// Check again, since another process could
+	// have acquired a lock at the same time.
+	if err := conflict(exclusive, name); err != nil {
+		os.Remove(l.path)
+		return nil, err
+	}
+	l.stopped.Add(1)
+	go l.refresh()
+	log.Printf("acquired %s", &l.info)
+	return l, nil
+}
+
+// refresh periodically updates heartbeat time until lock is released.
+// Lock path and key are remembered when acquiring, so that lock
+// is refreshed even if current settings are changed.
+func (l *Lock) refresh() {
+	defer l.stopped.Done()
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.info.Heartbeat = time.Now()
+			if err := l.info.store(l.path, &l.key); err != nil {
+				log.Printf("failed to refresh lock: %s", err)
+			}
+		}
+	}
+}
+
+// Release releases lock.
+func (l *Lock) Release() error {
+	if l.released {
+		return nil
+	}
+	l.released = true
+	close(l.stop)
+	l.stopped.Wait()
+	log.Printf("released %s", &l.info)
+	return os.Remove(l.path)
+}
+
+// Remove removes stale locks, or, if all is true, all locks
+// including those held by running processes. It returns
+// removed locks.
+func Remove(all bool) ([]*Listed, error) {
+	locks, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var removed []*Listed
+	for _, l := range locks {
+		if !all && !l.IsStale() {
+			continue
+		}
+		if err := os.Remove(lockPath(l.Name)); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, l)
+	}
+	return removed, nil
+}
@@ -0,0 +1,189 @@
+package lock
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/internal/testrepo"
+)
+
+// useTempLocks makes locks be stored in a new temporary repository. It
+// returns function which removes it and restores settings and timeouts.
+func useTempLocks(t *testing.T) func() {
+	done := testrepo.Use(t)
+	staleTimeout, heartbeatInterval := StaleTimeout, HeartbeatInterval
+	return func() {
+		StaleTimeout, HeartbeatInterval = staleTimeout, heartbeatInterval
+		done()
+	}
+}
+
+func acquire(t *testing.T, exclusive bool) *Lock {
+	l, err := Acquire(exclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func release(t *testing.T, l *Lock) {
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectLocked(t *testing.T, exclusive bool, want string) {
+	l, err := Acquire(exclusive)
+	if err == nil {
+		l.Release()
+		t.Fatalf("acquired lock (exclusive=%v) while repository is locked", exclusive)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("error %q doesn't contain %q", err, want)
+	}
+}
+
+// storeLock stores lock file with the given info and
+// modification time, or random content if info is nil.
+func storeLock(t *testing.T, name string, info *Info, modTime time.Time) {
+	path := lockPath(namePrefix + name)
+	if info != nil {
+		if err := info.store(path, &config.Keys.SnapshotEnc); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		garbage := make([]byte, 100)
+		rand.Read(garbage)
+		if err := ioutil.WriteFile(path, garbage, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lockNames(t *testing.T) []string {
+	locks, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range locks {
+		names = append(names, strings.TrimPrefix(l.Name, namePrefix))
+	}
+	return names
+}
+
+func TestConflicts(t *testing.T) {
+	defer useTempLocks(t)()
+
+	s1 := acquire(t, false)
+	s2 := acquire(t, false)
+	expectLocked(t, true, "shared lock by")
+	release(t, s1)
+	expectLocked(t, true, "shared lock by")
+	release(t, s2)
+
+	e := acquire(t, true)
+	expectLocked(t, false, "exclusive lock by")
+	expectLocked(t, true, "exclusive lock by")
+	release(t, e)
+	if err := e.Release(); err != nil {
+		t.Fatalf("second release: %s", err)
+	}
+
+	release(t, acquire(t, true))
+	if names := lockNames(t); len(names) != 0 {
+		t.Fatalf("locks left after release: %v", names)
+	}
+}
+
+func TestStaleLocks(t *testing.T) {
+	defer useTempLocks(t)()
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	old := now.Add(-StaleTimeout - time.Minute)
+
+	// Locks which are stale.
+	storeLock(t, "old", &Info{Exclusive: true, Hostname: "other", PID: 1, Heartbeat: old}, now)
+	storeLock(t, "dead", &Info{Exclusive: true, Hostname: hostname, PID: 1 << 30, Heartbeat: now}, now)
+	storeLock(t, "unreadable-old", nil, old)
+	release(t, acquire(t, true))
+
+	// Locks which are not.
+	storeLock(t, "unreadable", nil, now)
+	expectLocked(t, false, "failed to decrypt")
+	os.Remove(lockPath(namePrefix + "unreadable"))
+
+	storeLock(t, "other", &Info{Exclusive: false, Hostname: "other", PID: 1, Heartbeat: now}, now)
+	release(t, acquire(t, false))
+	expectLocked(t, true, "shared lock by")
+
+	storeLock(t, "alive", &Info{Exclusive: true, Hostname: hostname, PID: os.Getpid(), Heartbeat: now}, now)
+	expectLocked(t, false, "exclusive lock by")
+
+	removed, err := Remove(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 {
+		t.Fatalf("removed %d stale locks, want 3", len(removed))
+	}
+	if names := strings.Join(lockNames(t), " "); names != "alive other" {
+		t.Fatalf("locks left after removing stale: %s", names)
+	}
+	if _, err := Remove(true); err != nil {
+		t.Fatal(err)
+	}
+	if names := lockNames(t); len(names) != 0 {
+		t.Fatalf("locks left after removing all: %v", names)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	defer useTempLocks(t)()
+	StaleTimeout = 500 * time.Millisecond
+	HeartbeatInterval = 10 * time.Millisecond
+
+	l := acquire(t, true)
+	defer l.Release()
+	name := strings.TrimPrefix(l.path, config.LocksPath+string(os.PathSeparator))
+	first, err := load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lock is refreshed and doesn't become stale
+	// while it's held for longer than StaleTimeout.
+	deadline := time.Now().Add(2 * StaleTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		info, err := load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsStale() {
+			t.Fatalf("lock became stale, heartbeat %s", info.Heartbeat)
+		}
+	}
+	info, err := load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Heartbeat.After(first.Heartbeat) || !info.Time.Equal(first.Time) {
+		t.Fatalf("heartbeat wasn't refreshed: %+v, acquired %+v", info, first)
+	}
+	expectLocked(t, false, "exclusive lock by")
+
+	// After release, lock file isn't written again.
+	release(t, l)
+	time.Sleep(5 * HeartbeatInterval)
+	if names := lockNames(t); len(names) != 0 {
+		t.Fatalf("lock file reappeared after release: %v", names)
+	}
+}
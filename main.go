@@ -2,6 +2,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -9,22 +10,74 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dchest/hesfic/block"
 	"github.com/dchest/hesfic/config"
 	"github.com/dchest/hesfic/dir"
+	"github.com/dchest/hesfic/hook"
+	"github.com/dchest/hesfic/lock"
+	"github.com/dchest/hesfic/progress"
 	"github.com/dchest/hesfic/snapshot"
 	"github.com/dchest/hesfic/web"
 )
 
+// Version of hesfic.
+const version = "0.2-dev"
+
 var (
 	configFlag  = flag.String("config", "", "config file path")
 	keysFlag    = flag.String("keys", "", "key file path")
 	commentFlag = flag.String("comment", "", "comment to use when creating snapshot")
 	logFlag     = flag.Bool("log", false, "log actions")
+	jsonFlag    = flag.Bool("json", false, "output in JSON format")
 	dryRunFlag  = flag.Bool("dry", false, "do not change files")
+	allFlag     = flag.Bool("all", false, "unlock: remove all locks, not only stale ones")
+	repairFlag  = flag.Bool("repair", false, "check: rebuild damaged blocks from source files")
+
+	progressFlag = flag.Bool("progress", false, "show progress of create, restore, verify and gc (as JSON lines with -json)")
+
+	workersFlag = flag.Int("workers", 4, "number of files to restore concurrently")
+	tagFlag     = flag.String("tag", "", "comma-separated tags to use when creating snapshot or to select snapshots")
+	hostFlag    = flag.String("host", "", "host name to use when creating snapshot or to select snapshots")
+	userFlag    = flag.String("user", "", "user name to use when creating snapshot or to select snapshots")
+	pathFlag    = flag.String("path", "", "source path to select snapshots")
+
+	excludeFlag   = flag.String("exclude", "", "create: comma-separated patterns of files to exclude (e.g. *.tmp,/home/me/.cache)")
+	onErrorFlag   = flag.String("on-error", "", "create: what to do with unreadable files, skip or abort (default: from config, or skip)")
+	stdinFlag     = flag.Bool("stdin", false, "create: read file content from standard input")
+	stdinNameFlag = flag.String("stdin-name", "stdin", "create: file name to use for content read from standard input")
+	nameFlag      = flag.String("name", "-", "import: source path to record in snapshot")
+
+	offsetFlag = flag.Int64("offset", 0, "cat: byte offset to start output from (negative: from the end)")
+	lengthFlag = flag.Int64("length", -1, "cat: maximum number of bytes to output (default: until the end)")
+
+	regexFlag   = flag.Bool("regex", false, "find: pattern is a regular expression instead of shell pattern")
+	typeFlag    = flag.String("type", "", "find: type of entries to find, f (file) or d (directory)")
+	minSizeFlag = flag.String("min-size", "", "find: minimum file size (e.g. 10M)")
+	maxSizeFlag = flag.String("max-size", "", "find: maximum file size (e.g. 1G)")
+	newerFlag   = flag.String("newer", "", "find: files modified after time (e.g. 2013-05-01, \"3 days ago\")")
+	olderFlag   = flag.String("older", "", "find: files modified before time")
+
+	readDataSubsetFlag = flag.String("read-data-subset", "", "check: percentage of data blocks to read and verify (e.g. 10%)")
+
+	toConfigFlag = flag.String("to-config", "", "copy: config file path of destination repository")
+	toKeysFlag   = flag.String("to-keys", "", "copy: key file path of destination repository (default: same as -keys)")
+
+	keepLastFlag    = flag.Int("keep-last", 0, "forget: keep n last snapshots")
+	keepHourlyFlag  = flag.Int("keep-hourly", 0, "forget: keep the last snapshot for each of n last hours")
+	keepDailyFlag   = flag.Int("keep-daily", 0, "forget: keep the last snapshot for each of n last days")
+	keepWeeklyFlag  = flag.Int("keep-weekly", 0, "forget: keep the last snapshot for each of n last weeks")
+	keepMonthlyFlag = flag.Int("keep-monthly", 0, "forget: keep the last snapshot for each of n last months")
+	keepYearlyFlag  = flag.Int("keep-yearly", 0, "forget: keep the last snapshot for each of n last years")
+	keepWithinFlag  = flag.String("keep-within", "", "forget: keep snapshots made within duration (e.g. 36h, 10d, 2w, 6mo, 1y)")
+	keepTagFlag     = flag.String("keep-tag", "", "forget: keep snapshots with any of comma-separated tags")
 )
 
 func getConfigDir() string {
@@ -37,16 +90,78 @@ func getConfigDir() string {
 }
 
 func fatal(format string, v ...interface{}) {
+	exit(1, format, v...)
+}
+
+// Exit status when snapshot was created, but some files were skipped.
+const exitPartial = 3
+
+// exit prints message and exits with the given status.
+func exit(status int, format string, v ...interface{}) {
+	if *jsonFlag {
+		// Print {"Error": msg} or, for warnings, {"Warning": msg}.
+		key, msg := "Error", fmt.Sprintf(format, v...)
+		if strings.HasPrefix(msg, "warning: ") {
+			key = "Warning"
+		}
+		msg = strings.TrimPrefix(strings.TrimPrefix(msg, "warning: "), "error: ")
+		data, _ := json.Marshal(map[string]string{key: msg})
+		fmt.Fprintf(os.Stderr, "%s\n", data)
+		os.Exit(status)
+	}
 	if *logFlag {
-		log.Fatalf(format, v...)
+		log.Printf(format, v...)
+		os.Exit(status)
 	}
 	fmt.Fprintf(os.Stderr, format+"\n", v...)
-	os.Exit(1)
+	os.Exit(status)
+}
+
+// partialError is returned when snapshot was created,
+// but some files were skipped because of errors.
+type partialError struct {
+	name    string
+	skipped int
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("snapshot %s created, but %d files were skipped", e.name, e.skipped)
+}
+
+// args contains command-line arguments without flags.
+var args []string
+
+// parseArgs parses command-line flags, which, unlike with flag.Parse,
+// may follow arguments, e.g. "hesfic copy latest -to-config other".
+// Everything after "--" is an argument.
+func parseArgs() {
+	rest := os.Args[1:]
+	for {
+		flag.CommandLine.Parse(rest)
+		if n := len(rest) - flag.NArg(); n > 0 && rest[n-1] == "--" {
+			args = append(args, flag.Args()...)
+			return
+		}
+		if flag.NArg() == 0 {
+			return
+		}
+		args = append(args, flag.Arg(0))
+		rest = flag.Args()[1:]
+	}
+}
+
+// arg returns the i'th command-line argument without flags,
+// or an empty string if there is no such argument.
+func arg(i int) string {
+	if i < 0 || i >= len(args) {
+		return ""
+	}
+	return args[i]
 }
 
 func main() {
-	flag.Parse()
-	if flag.NArg() < 1 {
+	parseArgs()
+	if len(args) < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -65,7 +180,7 @@ func main() {
 		keysPath = filepath.Join(getConfigDir(), "keys")
 	}
 
-	if flag.Arg(0) == "genkeys" {
+	if arg(0) == "genkeys" {
 		if err := config.GenerateKeys(keysPath); err != nil {
 			fatal("error: %s", err)
 		}
@@ -82,81 +197,453 @@ func main() {
 
 	// Figure out action.
 	var err error
-	switch flag.Arg(0) {
+	switch arg(0) {
 	case "create":
-		err = createSnapshot()
+		err = withHooks("create", func() error { return withLock(false, createSnapshot) })
 	case "restore":
-		err = restoreSnapshot()
+		err = withHooks("restore", func() error { return withLock(false, restoreSnapshot) })
 	case "verify":
-		err = verifySnapshot()
+		err = withLock(false, verifySnapshot)
+	case "check":
+		err = withLock(false, check)
 	case "list-snapshots":
 		err = listSnapshots()
 	case "list-files":
 		err = listFiles()
+	case "cat":
+		err = withLock(false, catFile)
+	case "find":
+		err = withLock(false, find)
+	case "history":
+		err = withLock(false, history)
+	case "stats":
+		err = withLock(false, stats)
+	case "export":
+		err = withLock(false, exportSnapshot)
+	case "import":
+		err = withLock(false, importSnapshot)
 	case "show-ref":
 		err = showRef()
+	case "backup":
+		err = backup()
+	case "daemon":
+		err = runDaemon(configPath, keysPath)
+	case "copy":
+		err = withLock(false, func() error { return copySnapshots(keysPath) })
 	case "gc":
-		err = gc()
+		err = withLock(!*dryRunFlag, gc)
+	case "forget":
+		err = withLock(!*dryRunFlag, forget)
+	case "unlock":
+		err = unlock()
 	case "web":
 		err = serveWeb()
 	default:
-		err = fmt.Errorf("unknown command: %s", flag.Arg(0))
+		err = fmt.Errorf("unknown command: %s", arg(0))
 	}
 	if err != nil {
+		if exitStatus(err) == exitPartial {
+			exit(exitPartial, "warning: %s", err)
+		}
 		fatal("error: %s", err)
 	}
 }
 
+// exitStatus returns exit status for error returned by command.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if _, ok := err.(*partialError); ok {
+		return exitPartial
+	}
+	return 1
+}
+
+// hookEnv contains environment variables for post-operation hooks,
+// which are set by commands to describe their results.
+var hookEnv = make(map[string]string)
+
+// withHooks runs pre-op hooks, then fn, then post-op hooks. Post-op hooks
+// are run even if pre-op hooks or fn fail, with HESFIC_STATUS set to exit
+// status, and HESFIC_ERROR set to error message, if any.
+func withHooks(op string, fn func() error) error {
+	err := hook.Run("pre-"+op, hookEnv)
+	if err == nil {
+		err = fn()
+	}
+	hookEnv["HESFIC_STATUS"] = strconv.Itoa(exitStatus(err))
+	if err != nil {
+		hookEnv["HESFIC_ERROR"] = err.Error()
+	}
+	if herr := hook.Run("post-"+op, hookEnv); herr != nil && err == nil {
+		err = herr
+	}
+	return err
+}
+
+// withLock calls fn while holding shared or exclusive repository lock.
+func withLock(exclusive bool, fn func() error) error {
+	l, err := lock.Acquire(exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	return fn()
+}
+
+func unlock() error {
+	removed, err := lock.Remove(*allFlag)
+	if *jsonFlag {
+		list := make([]*lockJSON, 0, len(removed))
+		for _, l := range removed {
+			list = append(list, &lockJSON{l.Name, l.Info, errorString(l.Err)})
+		}
+		if jerr := printJSON(list); err == nil {
+			err = jerr
+		}
+		return err
+	}
+	for _, l := range removed {
+		if l.Err != nil {
+			fmt.Printf("removed unreadable lock %s: %s\n", l.Name, l.Err)
+		} else {
+			fmt.Printf("removed %s\n", l.Info)
+		}
+	}
+	return err
+}
+
 func createSnapshot() error {
-	if flag.NArg() < 2 || flag.Arg(1) == "" {
-		return fmt.Errorf("expecting directory name")
+	info := &snapshot.Info{
+		Comment:  *commentFlag,
+		Tags:     splitList(*tagFlag),
+		Hostname: *hostFlag,
+		Username: *userFlag,
+		Version:  version,
+	}
+	if *stdinFlag {
+		if len(args) > 1 {
+			return fmt.Errorf("cannot use paths with -stdin")
+		}
+		if *stdinNameFlag == "" || strings.ContainsAny(*stdinNameFlag, `/\`) {
+			return fmt.Errorf("bad -stdin-name %q", *stdinNameFlag)
+		}
+		config.MakePaths()
+		stop := startProgress("create", nil)
+		name, err := snapshot.CreateFromReader(os.Stdin, *stdinNameFlag, info)
+		stop()
+		if err != nil {
+			return err
+		}
+		return printCreated(name)
+	}
+	if len(args) < 2 || arg(1) == "" {
+		return fmt.Errorf("expecting directory or file names")
+	}
+	exclude := splitList(*excludeFlag)
+	if err := config.ValidatePatterns(exclude); err != nil {
+		return err
+	}
+	config.Exclude = append(config.Exclude, exclude...)
+	return createFrom(args[1:], info)
+}
+
+// createFrom creates snapshot of files and directories at paths.
+func createFrom(paths []string, info *snapshot.Info) error {
+	switch *onErrorFlag {
+	case "":
+	case config.OnErrorSkip, config.OnErrorAbort:
+		config.OnError = *onErrorFlag
+	default:
+		return fmt.Errorf("bad -on-error %q, expecting skip or abort", *onErrorFlag)
 	}
 	config.MakePaths()
-	dir := flag.Arg(1)
-	return snapshot.Create(dir, *commentFlag)
+	stop := startProgress("create", func(cancel <-chan struct{}) (int64, int64) {
+		return dir.Scan(paths, cancel)
+	})
+	name, err := snapshot.Create(paths, info)
+	stop()
+	if err != nil {
+		return err
+	}
+	return printCreated(name)
+}
+
+// printCreated prints information about created snapshot if JSON
+// output is requested, otherwise prints skipped files to standard
+// error. If some files were skipped, it returns partialError.
+func printCreated(name string) error {
+	info, err := snapshot.LoadInfo(name)
+	if err != nil {
+		return err
+	}
+	hookEnv["HESFIC_SNAPSHOT"] = name
+	hookEnv["HESFIC_FILES"] = strconv.FormatInt(info.FileCount, 10)
+	hookEnv["HESFIC_BYTES"] = strconv.FormatInt(info.TotalBytes, 10)
+	hookEnv["HESFIC_NEW_BYTES"] = strconv.FormatInt(info.NewBytes, 10)
+	hookEnv["HESFIC_SKIPPED"] = strconv.Itoa(len(info.Skipped))
+	hookEnv["HESFIC_CHANGED"] = strconv.Itoa(len(info.Changed))
+	if *jsonFlag {
+		if err := printJSON(&snapshotJSON{name, info}); err != nil {
+			return err
+		}
+	} else {
+		for _, path := range info.Changed {
+			fmt.Fprintf(os.Stderr, "changed while reading, may be inconsistent: %s\n", path)
+		}
+		for _, sk := range info.Skipped {
+			fmt.Fprintf(os.Stderr, "skipped %s: %s\n", sk.Path, sk.Error)
+		}
+	}
+	if len(info.Skipped) > 0 {
+		return &partialError{name, len(info.Skipped)}
+	}
+	return nil
+}
+
+// startProgress starts reporting progress of operation op if requested
+// by flag and returns a function to stop it. If total is not nil, it is
+// called concurrently with operation to get the total number of files
+// and bytes for calculating ETA. It must return early when cancel is
+// closed, which happens when the operation finishes first.
+func startProgress(op string, total func(cancel <-chan struct{}) (files, bytes int64)) (stop func()) {
+	if !*progressFlag {
+		return func() {}
+	}
+	progress.Start(op, *jsonFlag)
+	if total == nil {
+		return progress.Stop
+	}
+	cancel := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		files, bytes := total(cancel)
+		select {
+		case <-cancel:
+			// Totals may be incomplete.
+		default:
+			progress.SetTotal(files, bytes)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(cancel)
+			<-done
+			progress.Stop()
+		})
+	}
+}
+
+// snapshotFilter returns filter for selecting snapshots from command-line flags.
+func snapshotFilter() *snapshot.Filter {
+	f := &snapshot.Filter{Tags: splitList(*tagFlag)}
+	if *hostFlag != "" {
+		f.Hosts = []string{*hostFlag}
+	}
+	if *userFlag != "" {
+		f.Users = []string{*userFlag}
+	}
+	if *pathFlag != "" {
+		abspath, err := filepath.Abs(*pathFlag)
+		if err != nil {
+			abspath = *pathFlag
+		}
+		f.Paths = []string{abspath}
+	}
+	return f
+}
+
+// splitList splits comma-separated list, omitting empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
 }
 
 func restoreSnapshot() error {
-	if flag.NArg() < 3 || flag.Arg(1) == "" || flag.Arg(2) == "" {
+	if len(args) < 3 || arg(1) == "" || arg(2) == "" {
 		return fmt.Errorf("expecting snapshot name and output directory name")
 	}
-	snapshotName := flag.Arg(1)
-	outDir := flag.Arg(2)
-	return snapshot.Restore(outDir, snapshotName)
+	sel, err := snapshot.SelectOne(arg(1), snapshotFilter())
+	if err != nil {
+		return err
+	}
+	outDir := arg(2)
+	hookEnv["HESFIC_SNAPSHOT"] = sel.Name
+	hookEnv["HESFIC_PATH"] = sel.Path
+	hookEnv["HESFIC_OUT_DIR"] = outDir
+	stop := startProgress("restore", sel.Totals)
+	err = snapshot.Restore(outDir, sel, *workersFlag)
+	stop()
+	if err != nil || !*jsonFlag {
+		return err
+	}
+	return printJSON(&struct {
+		Snapshot string
+		Path     string
+		OutDir   string
+	}{sel.Name, sel.Path, outDir})
 }
 
 func verifySnapshot() error {
-	names, err := getSnapshotNames(1)
+	sels, err := getSelections(1)
 	if err != nil {
 		return err
 	}
-	for _, name := range names {
-		if err := snapshot.Verify(name); err != nil {
+	stop := startProgress("verify", func(cancel <-chan struct{}) (files, bytes int64) {
+		for _, sel := range sels {
+			f, b := sel.Totals(cancel)
+			files += f
+			bytes += b
+		}
+		return
+	})
+	defer stop()
+	if *jsonFlag {
+		// Verify all selections and report results.
+		results := make([]*verifyJSON, 0, len(sels))
+		failed := 0
+		for _, sel := range sels {
+			err := snapshot.Verify(sel)
+			if err != nil {
+				failed++
+			}
+			results = append(results, &verifyJSON{sel.Name, sel.Path, err == nil, errorString(err)})
+		}
+		stop()
+		if err := printJSON(results); err != nil {
 			return err
 		}
-		log.Printf("snapshot %s OK", name)
+		if failed > 0 {
+			return fmt.Errorf("%d of %d failed verification", failed, len(sels))
+		}
+		return nil
+	}
+	for _, sel := range sels {
+		if err := snapshot.Verify(sel); err != nil {
+			return err
+		}
+		log.Printf("snapshot %s:%s OK", sel.Name, sel.Path)
+	}
+	return nil
+}
+
+// parsePercentage parses percentage such as "10%" and returns it
+// as a fraction from 0 to 1.
+func parsePercentage(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("bad percentage %q", s)
+	}
+	return p / 100, nil
+}
+
+func check() error {
+	readData, err := parsePercentage(*readDataSubsetFlag)
+	if err != nil {
+		return err
+	}
+	problems, repaired, err := snapshot.Check(&snapshot.CheckOptions{
+		ReadData: readData,
+		Repair:   *repairFlag,
+	})
+	if err != nil {
+		return err
+	}
+	repairedRefs := make(map[block.Ref]bool)
+	for _, ref := range repaired {
+		repairedRefs[*ref] = true
+	}
+	unrepaired := 0
+	list := make([]*problemJSON, 0, len(problems))
+	for _, p := range problems {
+		isRepaired := (p.Kind == snapshot.ProblemBlock || p.Kind == snapshot.ProblemTreeBlock) &&
+			repairedRefs[*p.Ref]
+		if !isRepaired && p.Kind != snapshot.ProblemOrphan {
+			unrepaired++
+		}
+		switch {
+		case *jsonFlag:
+			list = append(list, &problemJSON{p.Kind, p.Snapshot, p.Path, p.Ref,
+				errorString(p.Err), isRepaired})
+		case isRepaired:
+			fmt.Printf("%s (repaired)\n", p)
+		default:
+			fmt.Printf("%s\n", p)
+		}
+	}
+	if *jsonFlag {
+		if err := printJSON(list); err != nil {
+			return err
+		}
+	}
+	if unrepaired > 0 {
+		return fmt.Errorf("found %d problems", unrepaired)
 	}
 	return nil
 }
 
 func listSnapshots() error {
-	names, err := snapshot.GetNames()
+	names, err := getSnapshotNames(1)
 	if err != nil {
 		return err
 	}
+	if *jsonFlag {
+		list := make([]*snapshotJSON, 0, len(names))
+		for _, name := range names {
+			si, err := snapshot.LoadInfo(name)
+			if err != nil {
+				return err
+			}
+			list = append(list, &snapshotJSON{name, si})
+		}
+		return printJSON(list)
+	}
 	for _, name := range names {
 		si, err := snapshot.LoadInfo(name)
 		if err != nil {
 			return err
 		}
 
-		comment := ""
+		extra := ""
+		if si.Hostname != "" {
+			extra += "host:         " + si.Hostname + "\n"
+		}
+		if si.Username != "" {
+			extra += "user:         " + si.Username + "\n"
+		}
+		if si.FileCount > 0 {
+			extra += fmt.Sprintf("files:        %d (%s), added %s\n", si.FileCount,
+				strings.TrimSpace(sizeString(si.TotalBytes)), strings.TrimSpace(sizeString(si.NewBytes)))
+		}
+		if len(si.Skipped) > 0 {
+			extra += fmt.Sprintf("skipped:      %d files\n", len(si.Skipped))
+		}
+		if len(si.Changed) > 0 {
+			extra += fmt.Sprintf("inconsistent: %d files\n", len(si.Changed))
+		}
+		if si.Version != "" {
+			extra += "version:      " + si.Version + "\n"
+		}
+		if len(si.Tags) > 0 {
+			extra += "tags:         " + strings.Join(si.Tags, ", ") + "\n"
+		}
 		if si.Comment != "" {
-			comment = "comment:      " + si.Comment + "\n"
+			extra += "comment:      " + si.Comment + "\n"
 		}
 
 		fmt.Printf("snapshot:     %s\ndate:         %s\nsource path:  %s\nroot ref:     %s\n%s\n",
-			name, si.Time.Local().Format(time.RFC1123), si.SourcePath, si.DirRef, comment)
+			name, si.Time.Local().Format(time.RFC1123), si.SourcePath, si.DirRef, extra)
 	}
 	return nil
 }
@@ -183,17 +670,44 @@ func sizeString(n int64) string {
 	return fmt.Sprintf("%6d", n)
 }
 
-func listDirectory(name string, ref *block.Ref) error {
+// fileLister prints file entries, or collects them for JSON output.
+type fileLister struct {
+	files []*fileJSON
+}
+
+func (l *fileLister) add(snapshotName, path string, f *dir.Entry) {
+	if *jsonFlag {
+		l.files = append(l.files, &fileJSON{snapshotName, path, f})
+		return
+	}
+	if snapshotName != "" {
+		path = snapshotName + ":" + path
+	}
+	fmt.Printf("%s  %s  %s  %s\n", f.Mode, f.ModTime.Local().Format("02 Jan 2006 15:04"),
+		sizeString(f.Size), path)
+}
+
+// flush prints collected entries if JSON output is requested.
+func (l *fileLister) flush() error {
+	if !*jsonFlag {
+		return nil
+	}
+	if l.files == nil {
+		l.files = []*fileJSON{}
+	}
+	return printJSON(l.files)
+}
+
+func (l *fileLister) listDirectory(name string, ref *block.Ref) error {
 	files, err := dir.LoadDirectory(ref)
 	if err != nil {
 		return err
 	}
 	for _, f := range files {
 		fullpath := filepath.Join(name, f.Name)
-		fmt.Printf("%s  %s  %s  %s\n", f.Mode, f.ModTime.Local().Format("02 Jan 2006 15:04"),
-			sizeString(f.Size), fullpath)
+		l.add("", fullpath, f)
 		if f.Mode.IsDir() {
-			if err := listDirectory(fullpath, f.Ref); err != nil {
+			if err := l.listDirectory(fullpath, f.Ref); err != nil {
 				return err
 			}
 		}
@@ -202,34 +716,283 @@ func listDirectory(name string, ref *block.Ref) error {
 }
 
 func listFiles() error {
-	if flag.NArg() < 2 || flag.Arg(1) == "" {
+	if len(args) < 2 || arg(1) == "" {
 		return fmt.Errorf("expecting snapshot name or directory ref")
 	}
 
-	var dirRef *block.Ref
-	if snapshot.IsValidName(flag.Arg(1)) {
-		// Given snapshot ref, fetch index ref.
-		si, err := snapshot.LoadInfo(flag.Arg(1))
+	var l fileLister
+	if dirRef := block.RefFromHex([]byte(arg(1))); dirRef != nil {
+		if err := l.listDirectory("", dirRef); err != nil {
+			return err
+		}
+		return l.flush()
+	}
+	sel, err := snapshot.SelectOne(arg(1), snapshotFilter())
+	if err != nil {
+		return err
+	}
+	if !sel.Entry.Mode.IsDir() {
+		l.add("", sel.Path, sel.Entry)
+	} else if err := l.listDirectory(sel.Path, sel.Entry.Ref); err != nil {
+		return err
+	}
+	return l.flush()
+}
+
+func catFile() error {
+	if len(args) < 2 || arg(1) == "" {
+		return fmt.Errorf("expecting snapshot name and path, e.g. latest:docs/a.txt")
+	}
+	sel, err := snapshot.SelectOne(arg(1), snapshotFilter())
+	if err != nil {
+		return err
+	}
+	if sel.Entry.Mode.IsDir() {
+		return fmt.Errorf("%s:%s is a directory", sel.Name, sel.Path)
+	}
+	r, err := block.NewReader(sel.Entry.Ref)
+	if err != nil {
+		return err
+	}
+	if *offsetFlag != 0 {
+		whence := io.SeekStart
+		if *offsetFlag < 0 {
+			whence = io.SeekEnd
+		}
+		if _, err := r.Seek(*offsetFlag, whence); err != nil {
+			return err
+		}
+	}
+	if *lengthFlag >= 0 {
+		_, err = io.CopyN(os.Stdout, r, *lengthFlag)
+		if err == io.EOF {
+			err = nil
+		}
+	} else {
+		_, err = io.Copy(os.Stdout, r)
+	}
+	return err
+}
+
+// parseSize parses size in bytes, optionally followed
+// by K, M, G or T suffix for binary multiples.
+func parseSize(s string) (int64, error) {
+	mul := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			mul = 1 << 10
+		case 'M', 'm':
+			mul = 1 << 20
+		case 'G', 'g':
+			mul = 1 << 30
+		case 'T', 't':
+			mul = 1 << 40
+		}
+		if mul > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mul, nil
+}
+
+func find() error {
+	if len(args) < 2 || arg(1) == "" {
+		return fmt.Errorf("expecting file name pattern")
+	}
+	q := &snapshot.Query{MaxSize: -1, Type: *typeFlag}
+	if *regexFlag {
+		re, err := regexp.Compile(arg(1))
 		if err != nil {
 			return err
 		}
-		dirRef = si.DirRef
+		q.Regexp = re
 	} else {
-		dirRef = block.RefFromHex([]byte(flag.Arg(1)))
-		if dirRef == nil {
-			return fmt.Errorf("bad ref %q", flag.Arg(1))
+		if _, err := path.Match(arg(1), ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %s", arg(1), err)
 		}
+		q.Glob = arg(1)
+	}
+	if q.Type != "" && q.Type != "f" && q.Type != "d" {
+		return fmt.Errorf("bad type %q, expecting f or d", q.Type)
+	}
+	var err error
+	if *minSizeFlag != "" {
+		if q.MinSize, err = parseSize(*minSizeFlag); err != nil {
+			return err
+		}
+	}
+	if *maxSizeFlag != "" {
+		if q.MaxSize, err = parseSize(*maxSizeFlag); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if *newerFlag != "" {
+		if q.Newer, err = snapshot.ParseTime(*newerFlag, now); err != nil {
+			return err
+		}
+	}
+	if *olderFlag != "" {
+		if q.Older, err = snapshot.ParseTime(*olderFlag, now); err != nil {
+			return err
+		}
+	}
+	sels, err := getSelections(2)
+	if err != nil {
+		return err
+	}
+	var l fileLister
+	err = snapshot.Find(sels, q, func(sel *snapshot.Selection, f *snapshot.Found) error {
+		l.add(sel.Name, f.Path, f.Entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return l.flush()
+}
+
+func history() error {
+	if len(args) < 2 || arg(1) == "" {
+		return fmt.Errorf("expecting file path")
+	}
+	versions, err := snapshot.History(arg(1), snapshotFilter())
+	if err != nil {
+		return err
+	}
+	if *jsonFlag {
+		if versions == nil {
+			versions = []*snapshot.Version{}
+		}
+		return printJSON(versions)
+	}
+	const timeFormat = "02 Jan 2006 15:04"
+	for _, v := range versions {
+		fmt.Printf("%s  %s  %s .. %s  %3d  %s:%s\n", v.Entry.ModTime.Local().Format(timeFormat),
+			sizeString(v.Entry.Size), v.First.Time.Local().Format(timeFormat),
+			v.Last.Time.Local().Format(timeFormat), v.Count, v.LastName, v.Path)
+	}
+	return nil
+}
+
+// printJSON writes v to standard output as indented JSON.
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+// errorString returns error message or an empty string if err is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Types for JSON output.
+
+type snapshotJSON struct {
+	Name string
+	*snapshot.Info
+}
+
+type fileJSON struct {
+	Snapshot string `json:",omitempty"`
+	Path     string
+	*dir.Entry
+}
+
+type verifyJSON struct {
+	Snapshot string
+	Path     string
+	OK       bool
+	Error    string `json:",omitempty"`
+}
+
+type problemJSON struct {
+	Kind     string
+	Snapshot string     `json:",omitempty"`
+	Path     string     `json:",omitempty"`
+	Ref      *block.Ref `json:",omitempty"`
+	Error    string     `json:",omitempty"`
+	Repaired bool
+}
+
+type lockJSON struct {
+	Name  string
+	Info  *lock.Info `json:",omitempty"`
+	Error string     `json:",omitempty"`
+}
+
+func stats() error {
+	st, err := snapshot.GetStats()
+	if err != nil {
+		return err
+	}
+	if *jsonFlag {
+		return printJSON(st)
+	}
+	fmt.Printf("snapshots:          %d\n", st.Snapshots)
+	fmt.Printf("logical size:       %s\n", strings.TrimSpace(sizeString(st.LogicalBytes)))
+	fmt.Printf("unique blocks:      %d\n", st.Blocks)
+	fmt.Printf("data size:          %s\n", strings.TrimSpace(sizeString(st.DataBytes)))
+	fmt.Printf("stored size:        %s\n", strings.TrimSpace(sizeString(st.StoredBytes)))
+	fmt.Printf("padding:            %s\n", strings.TrimSpace(sizeString(st.PaddingBytes)))
+	fmt.Printf("dedup ratio:        %.2f\n", st.DedupRatio)
+	fmt.Printf("compression ratio:  %.2f\n", st.CompressionRatio)
+	fmt.Printf("\nexclusive size of snapshots:\n")
+	for _, ss := range st.SnapshotStats {
+		fmt.Printf("  %s  %s  %s  %s\n", ss.Name, ss.Time.Local().Format("02 Jan 2006 15:04"),
+			sizeString(ss.ExclusiveBytes), ss.SourcePath)
+	}
+	return nil
+}
+
+func exportSnapshot() error {
+	if len(args) < 2 || arg(1) == "" {
+		return fmt.Errorf("expecting snapshot name")
+	}
+	sel, err := snapshot.SelectOne(arg(1), snapshotFilter())
+	if err != nil {
+		return err
 	}
-	return listDirectory("", dirRef)
+	return snapshot.Export(os.Stdout, sel)
+}
+
+func importSnapshot() error {
+	if len(args) > 1 {
+		return fmt.Errorf("tar archive must be given on standard input")
+	}
+	config.MakePaths()
+	name, err := snapshot.Import(os.Stdin, *nameFlag, &snapshot.Info{
+		Comment:  *commentFlag,
+		Tags:     splitList(*tagFlag),
+		Hostname: *hostFlag,
+		Username: *userFlag,
+		Version:  version,
+	})
+	if err != nil {
+		return err
+	}
+	return printCreated(name)
 }
 
 func showRef() error {
-	if flag.NArg() < 2 || flag.Arg(1) == "" {
+	if len(args) < 2 || arg(1) == "" {
 		return fmt.Errorf("expecting block ref")
 	}
-	ref := block.RefFromHex([]byte(flag.Arg(1)))
+	ref := block.RefFromHex([]byte(arg(1)))
 	if ref == nil {
-		return fmt.Errorf("bad ref %s", flag.Arg(1))
+		return fmt.Errorf("bad ref %s", arg(1))
 	}
 	r, err := block.NewReader(ref)
 	if err != nil {
@@ -241,35 +1004,220 @@ func showRef() error {
 	return nil
 }
 
-func getSnapshotNames(argNo int) ([]string, error) {
-	if flag.NArg() > argNo {
-		// Names of snapshots to leave are given in arguments.
-		names := make([]string, 0, flag.NArg()-1)
-		for i := argNo; i < flag.NArg(); i++ {
-			name := flag.Arg(i)
-			if !snapshot.IsValidName(name) {
-				return nil, fmt.Errorf("invalid snapshot name %s", name)
+// getSelections returns snapshots selected by expressions given in
+// arguments starting from argNo, or all snapshots if there are no such
+// arguments. Only snapshots matching filter flags are returned.
+func getSelections(argNo int) ([]*snapshot.Selection, error) {
+	filter := snapshotFilter()
+	if len(args) <= argNo {
+		// All snapshots.
+		return snapshot.Select("", filter)
+	}
+	var sels []*snapshot.Selection
+	seen := make(map[string]bool)
+	for i := argNo; i < len(args); i++ {
+		ss, err := snapshot.Select(arg(i), filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, sel := range ss {
+			if key := sel.Name + ":" + sel.Path; !seen[key] {
+				seen[key] = true
+				sels = append(sels, sel)
 			}
-			names = append(names, name)
 		}
-		return names, nil
 	}
-	// All snapshots.
-	return snapshot.GetNames()
+	return sels, nil
+}
+
+// getSnapshotNames returns names of whole snapshots selected by
+// expressions given in arguments starting from argNo (see getSelections).
+func getSnapshotNames(argNo int) ([]string, error) {
+	sels, err := getSelections(argNo)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(sels))
+	for i, sel := range sels {
+		if sel.Path != "" {
+			return nil, fmt.Errorf("expecting whole snapshot, not %s:%s", sel.Name, sel.Path)
+		}
+		names[i] = sel.Name
+	}
+	return names, nil
 }
 
 func gc() (err error) {
+	// Blocks used only by snapshots that don't match filter
+	// would be removed, so don't allow filtering them out.
+	if !snapshotFilter().IsEmpty() {
+		return fmt.Errorf("gc can't be used with -tag, -host, -user or -path: use forget to remove snapshots")
+	}
 	namesToLeave, err := getSnapshotNames(1)
 	if err != nil {
 		return err
 	}
-	return snapshot.CollectGarbage(namesToLeave, *dryRunFlag)
+	garbage, err := collectGarbage(namesToLeave)
+	if err != nil {
+		return err
+	}
+	return printGarbage(garbage)
+}
+
+// collectGarbage collects garbage, keeping blocks used by snapshots
+// with the given names, and running gc hooks.
+func collectGarbage(namesToLeave []string) (garbage []*snapshot.Garbage, err error) {
+	err = withHooks("gc", func() error {
+		stop := startProgress("gc", nil)
+		garbage, err = snapshot.CollectGarbage(namesToLeave, *dryRunFlag)
+		stop()
+		if err != nil {
+			return err
+		}
+		var size int64
+		for _, g := range garbage {
+			size += g.Size
+		}
+		hookEnv["HESFIC_GARBAGE"] = strconv.Itoa(len(garbage))
+		hookEnv["HESFIC_GARBAGE_BYTES"] = strconv.FormatInt(size, 10)
+		hookEnv["HESFIC_DRY_RUN"] = strconv.FormatBool(*dryRunFlag)
+		return nil
+	})
+	return garbage, err
+}
+
+// printGarbage prints garbage found by garbage collection. In text
+// output, it is printed only for dry run.
+func printGarbage(garbage []*snapshot.Garbage) error {
+	if *jsonFlag {
+		if garbage == nil {
+			garbage = []*snapshot.Garbage{}
+		}
+		return printJSON(garbage)
+	}
+	if *dryRunFlag {
+		for _, g := range garbage {
+			fmt.Printf("%s\n", g)
+		}
+	}
+	return nil
+}
+
+func forget() (err error) {
+	names, err := getSnapshotNames(1)
+	if err != nil {
+		return err
+	}
+	within, err := config.ParseDuration(*keepWithinFlag)
+	if err != nil {
+		return err
+	}
+	policy := &snapshot.Policy{
+		Last:    *keepLastFlag,
+		Hourly:  *keepHourlyFlag,
+		Daily:   *keepDailyFlag,
+		Weekly:  *keepWeeklyFlag,
+		Monthly: *keepMonthlyFlag,
+		Yearly:  *keepYearlyFlag,
+		Within:  within,
+		Tags:    splitList(*keepTagFlag),
+	}
+	decisions, namesToLeave, err := snapshot.Forget(names, policy, *dryRunFlag)
+	if err != nil {
+		return err
+	}
+	garbage, err := collectGarbage(namesToLeave)
+	if err != nil {
+		return err
+	}
+	return printDecisions(decisions, garbage)
+}
+
+// printDecisions prints decisions made by applying retention policy
+// and garbage found by collecting garbage after it.
+func printDecisions(decisions []*snapshot.Decision, garbage []*snapshot.Garbage) error {
+	if *jsonFlag {
+		if decisions == nil {
+			decisions = []*snapshot.Decision{}
+		}
+		if garbage == nil {
+			garbage = []*snapshot.Garbage{}
+		}
+		return printJSON(&struct {
+			Decisions []*snapshot.Decision
+			Garbage   []*snapshot.Garbage
+		}{decisions, garbage})
+	}
+	group := ""
+	for _, d := range decisions {
+		if g := d.Info.SourcePath + " on " + d.Info.Hostname; g != group {
+			group = g
+			fmt.Printf("%s:\n", group)
+		}
+		action := "remove"
+		if d.Keep {
+			action = "keep  "
+		}
+		reasons := ""
+		if len(d.Reasons) > 0 {
+			reasons = "  (" + strings.Join(d.Reasons, ", ") + ")"
+		}
+		fmt.Printf("  %s %s  %s%s\n", action, d.Name,
+			d.Info.Time.Local().Format("02 Jan 2006 15:04"), reasons)
+	}
+	return printGarbage(garbage)
+}
+
+// copySnapshots copies snapshots selected by arguments (or all snapshots)
+// to repository given by -to-config and -to-keys flags.
+func copySnapshots(keysPath string) error {
+	if *toConfigFlag == "" {
+		return fmt.Errorf("destination config is not given, use -to-config")
+	}
+	toKeysPath := *toKeysFlag
+	if toKeysPath == "" {
+		toKeysPath = keysPath
+	}
+	names, err := getSnapshotNames(1)
+	if err != nil {
+		return err
+	}
+	src := config.Current()
+	dst, err := config.LoadSettings(*toConfigFlag, toKeysPath)
+	if err != nil {
+		return err
+	}
+	if dst.SnapshotsPath == src.SnapshotsPath {
+		return fmt.Errorf("source and destination repositories are the same")
+	}
+	// Lock destination repository.
+	dst.Use()
+	config.MakePaths()
+	l, err := lock.Acquire(false)
+	src.Use()
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	if err := snapshot.Copy(names, src, dst); err != nil {
+		return err
+	}
+	if *jsonFlag {
+		if names == nil {
+			names = []string{}
+		}
+		return printJSON(names)
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
 }
 
 func serveWeb() (err error) {
 	addr := "localhost:0"
-	if flag.NArg() > 0 && flag.Arg(1) != "" {
-		addr = flag.Arg(1)
+	if len(args) > 0 && arg(1) != "" {
+		addr = arg(1)
 	}
 	return web.Serve(addr)
 }
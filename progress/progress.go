@@ -0,0 +1,254 @@
+// Package progress reports progress of long operations.
+//
+// Counters are updated by packages doing the work, such as block and dir,
+// and are periodically rendered on standard error as a status line or
+// as JSON lines. Counters are reset when reporting
+// is started.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between reports.
+var Interval = time.Second
+
+// Report is a snapshot of progress counters.
+type Report struct {
+	Op         string
+	Files      int64 // number of processed files
+	TotalFiles int64 `json:",omitempty"` // total number of files, if known
+	Bytes      int64 // number of processed bytes
+	TotalBytes int64 `json:",omitempty"` // total number of bytes, if known
+	NewBytes   int64 // bytes in newly stored blocks
+	DedupBytes int64 // bytes in blocks which were already stored
+	Rate       int64 // bytes per second
+	Elapsed    time.Duration
+	ETA        time.Duration `json:",omitempty"` // estimated remaining time, if known
+	Done       bool
+}
+
+var state struct {
+	// Counters, updated atomically, must be first
+	// for alignment on 32-bit systems.
+	files      int64
+	bytes      int64
+	newBytes   int64
+	dedupBytes int64
+	totalFiles int64
+	totalBytes int64
+
+	started int32
+
+	mu      sync.Mutex
+	op      string
+	start   time.Time
+	asJSON  bool
+	lineLen int
+	stop    chan bool
+	stopped sync.WaitGroup
+}
+
+// Start starts reporting progress of operation op every Interval on standard
+// error, either as a status line or, if asJSON is true, as JSON lines, so
+// that they are not mixed with the result of operation on standard output.
+func Start(op string, asJSON bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if atomic.LoadInt32(&state.started) != 0 {
+		return
+	}
+	atomic.StoreInt64(&state.files, 0)
+	atomic.StoreInt64(&state.bytes, 0)
+	atomic.StoreInt64(&state.newBytes, 0)
+	atomic.StoreInt64(&state.dedupBytes, 0)
+	atomic.StoreInt64(&state.totalFiles, 0)
+	atomic.StoreInt64(&state.totalBytes, 0)
+	state.op = op
+	state.start = time.Now()
+	state.asJSON = asJSON
+	state.lineLen = 0
+	state.stop = make(chan bool)
+	atomic.StoreInt32(&state.started, 1)
+	state.stopped.Add(1)
+	go run(state.stop)
+}
+
+func run(stop chan bool) {
+	defer state.stopped.Done()
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			printReport(false)
+		}
+	}
+}
+
+// Stop stops reporting and prints the final report.
+func Stop() {
+	if atomic.LoadInt32(&state.started) == 0 {
+		return
+	}
+	close(state.stop)
+	state.stopped.Wait()
+	printReport(true)
+	atomic.StoreInt32(&state.started, 0)
+}
+
+// Started returns true if progress is being reported.
+func Started() bool {
+	return atomic.LoadInt32(&state.started) != 0
+}
+
+// SetTotal sets the total number of files and bytes,
+// for example, found by pre-scanning, to calculate ETA.
+func SetTotal(files, bytes int64) {
+	atomic.StoreInt64(&state.totalFiles, files)
+	atomic.StoreInt64(&state.totalBytes, bytes)
+}
+
+// AddFile increments the number of processed files.
+func AddFile() {
+	atomic.AddInt64(&state.files, 1)
+}
+
+// AddBytes adds n to the number of processed bytes.
+func AddBytes(n int64) {
+	atomic.AddInt64(&state.bytes, n)
+}
+
+// AddBlock adds data size of stored block to the number of new
+// bytes if isNew is true, or to the number of deduplicated bytes.
+func AddBlock(size int, isNew bool) {
+	if isNew {
+		atomic.AddInt64(&state.newBytes, int64(size))
+	} else {
+		atomic.AddInt64(&state.dedupBytes, int64(size))
+	}
+}
+
+type reader struct {
+	r io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	AddBytes(int64(n))
+	return n, err
+}
+
+// NewReader returns a reader, which adds the number
+// of bytes read from r to processed bytes.
+func NewReader(r io.Reader) io.Reader {
+	if !Started() {
+		return r
+	}
+	return &reader{r}
+}
+
+// Current returns the current report.
+func Current() *Report {
+	state.mu.Lock()
+	op, start := state.op, state.start
+	state.mu.Unlock()
+	rep := &Report{
+		Op:         op,
+		Files:      atomic.LoadInt64(&state.files),
+		TotalFiles: atomic.LoadInt64(&state.totalFiles),
+		Bytes:      atomic.LoadInt64(&state.bytes),
+		TotalBytes: atomic.LoadInt64(&state.totalBytes),
+		NewBytes:   atomic.LoadInt64(&state.newBytes),
+		DedupBytes: atomic.LoadInt64(&state.dedupBytes),
+		Elapsed:    time.Since(start),
+	}
+	if secs := rep.Elapsed.Seconds(); secs > 0 {
+		rep.Rate = int64(float64(rep.Bytes) / secs)
+	}
+	if rep.Rate > 0 && rep.TotalBytes > rep.Bytes {
+		rep.ETA = time.Duration(float64(rep.TotalBytes-rep.Bytes) / float64(rep.Rate) * float64(time.Second))
+	}
+	return rep
+}
+
+func printReport(done bool) {
+	rep := Current()
+	rep.Done = done
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.asJSON {
+		data, err := json.Marshal(rep)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", data)
+		return
+	}
+	line := rep.String()
+	pad := ""
+	if n := state.lineLen - len(line); n > 0 {
+		pad = strings.Repeat(" ", n)
+	}
+	state.lineLen = len(line)
+	end := ""
+	if done {
+		end = "\n"
+	}
+	fmt.Fprintf(os.Stderr, "\r%s%s%s", line, pad, end)
+}
+
+// String returns report as a single line of text.
+func (rep *Report) String() string {
+	s := rep.Op + ": "
+	if rep.TotalFiles > 0 {
+		s += fmt.Sprintf("%d/%d files, ", rep.Files, rep.TotalFiles)
+	} else {
+		s += fmt.Sprintf("%d files, ", rep.Files)
+	}
+	if rep.TotalBytes > 0 {
+		s += fmt.Sprintf("%s/%s (%d%%)", sizeString(rep.Bytes), sizeString(rep.TotalBytes),
+			rep.Bytes*100/rep.TotalBytes)
+	} else {
+		s += sizeString(rep.Bytes)
+	}
+	if rep.NewBytes > 0 || rep.DedupBytes > 0 {
+		s += fmt.Sprintf(", new %s, dedup %s", sizeString(rep.NewBytes), sizeString(rep.DedupBytes))
+	}
+	s += fmt.Sprintf(", %s/s", sizeString(rep.Rate))
+	if rep.Done {
+		s += fmt.Sprintf(", done in %s", rep.Elapsed/time.Second*time.Second)
+	} else if rep.ETA > 0 {
+		s += fmt.Sprintf(", ETA %s", rep.ETA/time.Second*time.Second)
+	}
+	return s
+}
+
+func sizeString(n int64) string {
+	const (
+		KiB = 1024
+		MiB = 1024 * KiB
+		GiB = 1024 * MiB
+		TiB = 1024 * GiB
+	)
+	switch {
+	case n >= TiB:
+		return fmt.Sprintf("%.1fT", float64(n)/TiB)
+	case n >= GiB:
+		return fmt.Sprintf("%.1fG", float64(n)/GiB)
+	case n >= MiB:
+		return fmt.Sprintf("%.1fM", float64(n)/MiB)
+	case n >= KiB:
+		return fmt.Sprintf("%.1fK", float64(n)/KiB)
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,110 @@
+// Package safefile implements crash-safe writing of files.
+//
+// Data is written into a temporary file in the same directory as the
+// destination file, which is then synced to disk and renamed over the
+// destination, after which the directory is synced too. Thus, after a
+// crash, the destination either doesn't exist or has complete content.
+package safefile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefix of temporary file names.
+const tempPrefix = ".tmp-"
+
+// File is a temporary file, which replaces the destination file
+// when committed.
+type File struct {
+	*os.File
+	path   string
+	perm   os.FileMode
+	closed bool
+}
+
+// Create creates a new temporary file for writing into the given path.
+// The file must be either committed with Commit or removed with Close.
+func Create(path string, perm os.FileMode) (*File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), tempPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f, path: path, perm: perm}, nil
+}
+
+// Commit syncs and closes file, and renames it to the destination path.
+func (f *File) Commit() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if err := f.Chmod(f.perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.closed = true
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return SyncDir(filepath.Dir(f.path))
+}
+
+// Close closes and removes file if it wasn't committed.
+func (f *File) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// writeData writes data into file. Tests replace it to simulate
+// a crash in the middle of writing.
+var writeData = func(f *os.File, data []byte) (int, error) {
+	return f.Write(data)
+}
+
+// WriteFile atomically writes data into file at the given path.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := Create(path, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := writeData(f.File, data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Commit()
+}
+
+// SyncDir syncs directory, so that renames in it are persisted.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// IsTemp returns true if the name is a name of temporary file, which
+// can be left after a crash.
+func IsTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
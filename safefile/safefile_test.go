@@ -0,0 +1,126 @@
+package safefile
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errKilled = errors.New("killed")
+
+// killAt makes writeData write only the first n bytes
+// and then stop as if the process was killed.
+func killAt(n int) func() {
+	orig := writeData
+	writeData = func(f *os.File, data []byte) (int, error) {
+		if n < len(data) {
+			f.Write(data[:n])
+			panic(errKilled)
+		}
+		return f.Write(data)
+	}
+	return func() { writeData = orig }
+}
+
+// writeKilled calls WriteFile, which is killed after writing n bytes.
+// Since the panic skips cleanup, temporary file is left as after a crash.
+func writeKilled(t *testing.T, path string, data []byte, n int) {
+	restore := killAt(n)
+	defer restore()
+	defer func() {
+		if e := recover(); e != errKilled {
+			t.Fatalf("WriteFile was not killed: %v", e)
+		}
+	}()
+	WriteFile(path, data, 0644)
+}
+
+func TestWriteFileKilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		path := filepath.Join(dir, "file")
+		os.Remove(path)
+		var old []byte
+		if i%2 == 0 {
+			old = []byte("old content")
+			if err := WriteFile(path, old, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := make([]byte, 1+rnd.Intn(64*1024))
+		rnd.Read(data)
+		writeKilled(t, path, data, rnd.Intn(len(data)))
+
+		got, err := ioutil.ReadFile(path)
+		if old == nil {
+			if !os.IsNotExist(err) {
+				t.Fatalf("%d: file exists after killed write: %v", i, err)
+			}
+		} else if err != nil || !bytes.Equal(got, old) {
+			t.Fatalf("%d: old file changed by killed write: %v", i, err)
+		}
+
+		// Only temporary files are left.
+		names, err := readDirNames(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if name != "file" && !IsTemp(name) {
+				t.Fatalf("%d: unexpected file %s left", i, name)
+			}
+		}
+
+		// Writing again succeeds.
+		if err := WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err = ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d: bad content after rewrite: %v", i, err)
+		}
+	}
+}
+
+func TestCloseRemovesTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := Create(filepath.Join(dir, "file"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("partial"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("files left after Close: %v", names)
+	}
+}
+
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
@@ -0,0 +1,333 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/dir"
+)
+
+// Kinds of problems found by Check.
+const (
+	ProblemSnapshot  = "unreadable snapshot"
+	ProblemDirectory = "malformed directory"
+	ProblemBlock     = "damaged block"
+	ProblemTreeBlock = "damaged directory or pointer block"
+	ProblemOrphan    = "orphan block"
+)
+
+// Problem describes a problem found by Check.
+type Problem struct {
+	Kind     string
+	Snapshot string     // snapshot name, if known
+	Path     string     // path inside snapshot, if known
+	Ref      *block.Ref // block ref, if known
+	Err      error
+}
+
+func (p *Problem) String() string {
+	s := p.Kind
+	if p.Snapshot != "" {
+		s += " in " + p.Snapshot
+		if p.Path != "" {
+			s += ":" + p.Path
+		}
+	}
+	if p.Err != nil {
+		s += ": " + p.Err.Error()
+	} else if p.Ref != nil {
+		s += ": " + p.Ref.String()
+	}
+	return s
+}
+
+// CheckOptions are options for Check.
+type CheckOptions struct {
+	ReadData float64 // fraction of data blocks to read and verify, from 0 to 1
+	Repair   bool    // rebuild damaged blocks from source files
+}
+
+type checker struct {
+	opts     *CheckOptions
+	problems []*Problem
+	used     map[block.Ref]bool // refs of all blocks used by snapshots
+	damaged  map[block.Ref]bool // refs of damaged blocks
+	visited  map[block.Ref]bool // refs of already checked directories and files
+	verified map[block.Ref]bool // refs of blocks already read and verified
+}
+
+func (c *checker) add(p *Problem) {
+	log.Printf("%s", p)
+	c.problems = append(c.problems, p)
+}
+
+// addError adds problem caused by err, which is either an error
+// with block, added as problem of the given kind, or with directory
+// format.
+func (c *checker) addError(kind, name, path string, err error) {
+	var be *block.BlockError
+	if errors.As(err, &be) {
+		if c.damaged[*be.Ref] {
+			return // already reported
+		}
+		c.damaged[*be.Ref] = true
+		c.add(&Problem{Kind: kind, Snapshot: name, Path: path, Ref: be.Ref, Err: err})
+		return
+	}
+	c.add(&Problem{Kind: ProblemDirectory, Snapshot: name, Path: path, Err: err})
+}
+
+// markRefs marks ref and its subrefs as used. Pointer blocks, and all
+// blocks of directory if isDir is true, are verified, since walking and
+// loading directories reconstruct damaged blocks from parity without
+// reporting them.
+func (c *checker) markRefs(name, path string, ref *block.Ref, isDir bool) bool {
+	c.used[*ref] = true
+	err := block.WalkTree(ref, func(r *block.Ref, pointer bool) error {
+		c.used[*r] = true
+		if (pointer || isDir) && !c.verified[*r] {
+			c.verified[*r] = true
+			if err := block.Check(r); err != nil {
+				c.addError(ProblemTreeBlock, name, path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		kind := ProblemBlock
+		if isDir {
+			kind = ProblemTreeBlock
+		}
+		c.addError(kind, name, path, err)
+		return false
+	}
+	return true
+}
+
+func (c *checker) checkDirectory(name, path string, ref *block.Ref) {
+	if c.visited[*ref] {
+		return
+	}
+	c.visited[*ref] = true
+	if !c.markRefs(name, path, ref, true) {
+		return
+	}
+	entries, err := dir.LoadDirectory(ref)
+	if err != nil {
+		c.addError(ProblemTreeBlock, name, path, err)
+		return
+	}
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name)
+		if e.Ref == nil {
+			c.add(&Problem{Kind: ProblemDirectory, Snapshot: name, Path: p,
+				Err: errors.New("entry without ref")})
+			continue
+		}
+		if e.Mode.IsDir() {
+			c.checkDirectory(name, p, e.Ref)
+		} else if !c.visited[*e.Ref] {
+			c.visited[*e.Ref] = true
+			c.markRefs(name, p, e.Ref, false)
+		}
+	}
+}
+
+// checkBlocks checks that used data blocks exist, reading a fraction of them.
+func (c *checker) checkBlocks() {
+	for ref := range c.used {
+		if c.damaged[ref] || c.verified[ref] {
+			continue
+		}
+		r := ref
+		var err error
+		if c.opts.ReadData > 0 && rand.Float64() < c.opts.ReadData {
+			err = block.Check(&r)
+		} else {
+			err = block.CheckExists(&r)
+		}
+		if err != nil {
+			c.addError(ProblemBlock, "", "", err)
+		}
+	}
+}
+
+// checkOrphans reports blocks on disk which are not used by any snapshot.
+func (c *checker) checkOrphans() error {
+	return filepath.Walk(config.BlocksPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsDir() {
+			if len(fi.Name()) != 2 && path != config.BlocksPath {
+				return filepath.SkipDir // not a block directory, skip
+			}
+			return nil
+		}
+		ref := block.RefFromHex([]byte(filepath.Base(filepath.Dir(path)) + fi.Name()))
+		if ref == nil {
+			return nil // not a block, skip
+		}
+		if !c.used[*ref] {
+			c.add(&Problem{Kind: ProblemOrphan, Ref: ref})
+		}
+		return nil
+	})
+}
+
+// repairFile rebuilds damaged blocks of file from source file
+// at the given path, returning refs of repaired blocks.
+func (c *checker) repairFile(sourcePath string, entry *dir.Entry) []*block.Ref {
+	affected := false
+	err := block.WalkRefs(entry.Ref, func(r *block.Ref) error {
+		if c.damaged[*r] {
+			affected = true
+		}
+		return nil
+	})
+	if err != nil {
+		var be *block.BlockError
+		affected = errors.As(err, &be) && c.damaged[*be.Ref]
+	}
+	if !affected {
+		return nil
+	}
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		log.Printf("cannot repair from %s: %s", sourcePath, err)
+		return nil
+	}
+	defer f.Close()
+	ref, repaired, err := block.Repair(f, c.damaged)
+	if err != nil {
+		log.Printf("cannot repair from %s: %s", sourcePath, err)
+		return nil
+	}
+	if !ref.Equal(entry.Ref) {
+		log.Printf("source file %s has changed", sourcePath)
+	}
+	for _, r := range repaired {
+		log.Printf("repaired block %s from %s", r, sourcePath)
+		delete(c.damaged, *r)
+	}
+	return repaired
+}
+
+// repairFromParity reconstructs damaged blocks from parity.
+func (c *checker) repairFromParity() []*block.Ref {
+	var repaired []*block.Ref
+	for ref := range c.damaged {
+		r := ref
+		if err := block.RepairFromParity(&r); err != nil {
+			continue
+		}
+		log.Printf("repaired block %s from parity", &r)
+		delete(c.damaged, ref)
+		repaired = append(repaired, &r)
+	}
+	return repaired
+}
+
+// repair rebuilds damaged blocks from source files of snapshots.
+func (c *checker) repair(infos map[string]*Info) []*block.Ref {
+	var repaired []*block.Ref
+	visited := make(map[block.Ref]bool)
+	var repairDirectory func(sourcePath string, ref *block.Ref)
+	repairDirectory = func(sourcePath string, ref *block.Ref) {
+		if visited[*ref] || len(c.damaged) == 0 {
+			return
+		}
+		visited[*ref] = true
+		entries, err := dir.LoadDirectory(ref)
+		if err != nil {
+			return // can't repair directories
+		}
+		for _, e := range entries {
+			if e.Ref == nil {
+				continue
+			}
+			p := filepath.Join(sourcePath, e.Name)
+			if e.Mode.IsDir() {
+				repairDirectory(p, e.Ref)
+			} else {
+				repaired = append(repaired, c.repairFile(p, e)...)
+			}
+		}
+	}
+	for _, info := range infos {
+		if len(info.Sources) == 0 {
+			if info.SourcePath != "-" {
+				repairDirectory(info.SourcePath, info.DirRef)
+			}
+			continue
+		}
+		// Synthetic root: entries come from different source paths.
+		entries, err := dir.LoadDirectory(info.DirRef)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			for _, p := range info.Sources {
+				if filepath.Base(p) != e.Name || e.Ref == nil {
+					continue
+				}
+				if e.Mode.IsDir() {
+					repairDirectory(p, e.Ref)
+				} else {
+					repaired = append(repaired, c.repairFile(p, e)...)
+				}
+			}
+		}
+	}
+	return repaired
+}
+
+// Check checks all snapshots and blocks in repository and returns
+// problems it found. Blocks of directories and pointer blocks of files
+// are always read and verified, but unless options specify otherwise,
+// data blocks are only checked for existence and correct size. If repair is
+// requested, damaged blocks are rebuilt from source files if their
+// content matches, and refs of repaired blocks are returned.
+func Check(opts *CheckOptions) (problems []*Problem, repaired []*block.Ref, err error) {
+	c := &checker{
+		opts:     opts,
+		used:     make(map[block.Ref]bool),
+		damaged:  make(map[block.Ref]bool),
+		visited:  make(map[block.Ref]bool),
+		verified: make(map[block.Ref]bool),
+	}
+	names, err := GetNames()
+	if err != nil {
+		return nil, nil, err
+	}
+	infos := make(map[string]*Info)
+	for _, name := range names {
+		info, err := LoadInfo(name)
+		if err != nil {
+			c.add(&Problem{Kind: ProblemSnapshot, Snapshot: name, Err: err})
+			continue
+		}
+		if info.DirRef == nil {
+			c.add(&Problem{Kind: ProblemSnapshot, Snapshot: name,
+				Err: fmt.Errorf("no directory ref")})
+			continue
+		}
+		infos[name] = info
+		c.checkDirectory(name, "", info.DirRef)
+	}
+	c.checkBlocks()
+	if err := c.checkOrphans(); err != nil {
+		return c.problems, nil, err
+	}
+	if opts.Repair && len(c.damaged) > 0 {
+		repaired = c.repairFromParity()
+		repaired = append(repaired, c.repair(infos)...)
+	}
+	return c.problems, repaired, nil
+}
@@ -0,0 +1,143 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/dir"
+	"github.com/dchest/hesfic/internal/testrepo"
+)
+
+// createTestSnapshot creates snapshot of a new directory with a file large
+// enough to have a pointer block, and returns refs of root directory and
+// of the file.
+func createTestSnapshot(t *testing.T) (dirRef, fileRef *block.Ref) {
+	src, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	data := make([]byte, 10*config.BlockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	name, err := Create([]string{src}, &Info{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := block.FlushParity(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := LoadInfo(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := dir.Lookup(info.DirRef, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.DirRef, e.Ref
+}
+
+// damageBlock flips a byte in the middle of block file.
+func damageBlock(t *testing.T, ref *block.Ref) {
+	name := ref.String()
+	path := filepath.Join(config.BlocksPath, name[:2], name[2:])
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	os.Chmod(path, 0644)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkProblems runs Check and verifies that it reports exactly the given
+// damaged blocks with the given kind. Orphan blocks, which are reported
+// for blocks under unreadable pointer blocks, are ignored.
+func checkProblems(t *testing.T, opts *CheckOptions, kind string, refs ...*block.Ref) []*block.Ref {
+	problems, repaired, err := Check(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[block.Ref]bool)
+	for _, r := range refs {
+		want[*r] = true
+	}
+	for _, p := range problems {
+		if p.Kind == ProblemOrphan {
+			continue
+		}
+		if p.Kind != kind || p.Ref == nil || !want[*p.Ref] {
+			t.Fatalf("unexpected problem: %s", p)
+		}
+		delete(want, *p.Ref)
+	}
+	for r := range want {
+		t.Fatalf("damaged block %s not reported", &r)
+	}
+	return repaired
+}
+
+func TestCheckTreeBlocks(t *testing.T) {
+	defer testrepo.Use(t)()
+	config.ParityGroupSize = 4
+	config.ParityBlocks = 2
+	dirRef, fileRef := createTestSnapshot(t)
+	checkProblems(t, &CheckOptions{ReadData: 1}, "")
+
+	// Damaged blocks are reconstructed from parity when
+	// reading, but must still be reported.
+	damageBlock(t, dirRef)
+	damageBlock(t, fileRef)
+	checkProblems(t, &CheckOptions{}, ProblemTreeBlock, dirRef, fileRef)
+	repaired := checkProblems(t, &CheckOptions{Repair: true}, ProblemTreeBlock, dirRef, fileRef)
+	if len(repaired) != 2 {
+		t.Fatalf("repaired %d blocks, want 2", len(repaired))
+	}
+	checkProblems(t, &CheckOptions{ReadData: 1}, "")
+}
+
+func TestCheckRepairPointerFromSource(t *testing.T) {
+	defer testrepo.Use(t)()
+	src, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	data := make([]byte, 10*config.BlockSize)
+	rand.New(rand.NewSource(2)).Read(data)
+	path := filepath.Join(src, "file")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	name, err := Create([]string{path}, &Info{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := LoadInfo(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := dir.Lookup(info.DirRef, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without parity, damaged pointer block can't be walked, but
+	// can be rebuilt from source file.
+	damageBlock(t, e.Ref)
+	repaired := checkProblems(t, &CheckOptions{Repair: true}, ProblemBlock, e.Ref)
+	if len(repaired) != 1 || !repaired[0].Equal(e.Ref) {
+		t.Fatalf("repaired %v, want %s", repaired, e.Ref)
+	}
+	checkProblems(t, &CheckOptions{ReadData: 1}, "")
+}
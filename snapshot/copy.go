@@ -0,0 +1,190 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/dir"
+	"github.com/dchest/hesfic/progress"
+)
+
+// Copy copies snapshots with the given names and all blocks they
+// reference from repository with settings src to repository with
+// settings dst. Blocks that already exist in destination are skipped.
+//
+// If repositories use the same ref and block keys, encrypted blocks are
+// copied as is. Otherwise, blocks are decrypted and encrypted with
+// destination keys, and directories are rewritten to use new refs.
+//
+// Snapshots keep their names. Snapshots that already exist in
+// destination are skipped. Current settings are restored on return.
+//
+// Copy switches between repositories by changing current settings, so
+// nothing else may use blocks or settings while it runs: progress must
+// not be reported, and parity of blocks stored before Copy is flushed
+// into source repository first.
+func Copy(names []string, src, dst *config.Settings) error {
+	if progress.Started() {
+		return fmt.Errorf("copy can't be used while progress is reported")
+	}
+	src.Use()
+	if err := block.FlushParity(); err != nil {
+		return err
+	}
+	defer src.Use()
+	sameKeys := src.Keys.RefHash == dst.Keys.RefHash &&
+		src.Keys.BlockEnc == dst.Keys.BlockEnc
+	for _, name := range names {
+		src.Use()
+		info, err := LoadInfo(name)
+		if err != nil {
+			return err
+		}
+		dst.Use()
+		if _, err := os.Stat(filepath.Join(config.SnapshotsPath, name)); err == nil {
+			log.Printf("snapshot %s already exists, skipping", name)
+			continue
+		}
+		var c copier
+		if sameKeys {
+			err = c.copyRaw(info.DirRef, src, dst)
+		} else {
+			c.dirs = make(map[block.Ref]*block.Ref)
+			c.files = make(map[block.Ref]*block.Ref)
+			info.DirRef, err = c.copyDirectory(info.DirRef, src, dst)
+		}
+		if err != nil {
+			return err
+		}
+		dst.Use()
+		if err := block.FlushParity(); err != nil {
+			return err
+		}
+		if err := info.storeAs(name); err != nil {
+			return err
+		}
+		log.Printf("copied snapshot %s", name)
+	}
+	return nil
+}
+
+type copier struct {
+	dirs  map[block.Ref]*block.Ref // source directory ref -> destination ref
+	files map[block.Ref]*block.Ref // source file ref -> destination ref
+}
+
+// copyRaw copies encrypted blocks reachable from directory dirRef.
+func (c *copier) copyRaw(dirRef *block.Ref, src, dst *config.Settings) error {
+	src.Use()
+	refs := []*block.Ref{dirRef}
+	seen := make(map[block.Ref]bool)
+	collect := func(ref *block.Ref) error {
+		if !seen[*ref] {
+			seen[*ref] = true
+			refs = append(refs, ref)
+		}
+		return nil
+	}
+	if err := block.WalkRefs(dirRef, collect); err != nil {
+		return err
+	}
+	err := dir.Walk(dirRef, func(path string, e *dir.Entry) error {
+		return block.WalkRefs(e.Ref, collect)
+	})
+	if err != nil {
+		return err
+	}
+	copied := 0
+	for _, ref := range refs {
+		dst.Use()
+		if block.Exists(ref) {
+			continue
+		}
+		src.Use()
+		box, err := block.ReadRaw(ref)
+		if err != nil {
+			return err
+		}
+		dst.Use()
+		if err := block.WriteRaw(ref, box); err != nil {
+			return err
+		}
+		copied++
+	}
+	log.Printf("copied %d blocks, %d already existed", copied, len(refs)-copied)
+	return nil
+}
+
+// copyDirectory re-encrypts directory with the given ref and its
+// contents with destination keys, and returns its new ref.
+func (c *copier) copyDirectory(ref *block.Ref, src, dst *config.Settings) (*block.Ref, error) {
+	if newRef, ok := c.dirs[*ref]; ok {
+		return newRef, nil
+	}
+	src.Use()
+	entries, err := dir.LoadDirectory(ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Mode.IsDir() {
+			e.Ref, err = c.copyDirectory(e.Ref, src, dst)
+		} else {
+			e.Ref, err = c.copyFile(e.Ref, src, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	dst.Use()
+	newRef, _, err := dir.SaveEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	c.dirs[*ref] = newRef
+	return newRef, nil
+}
+
+// copyFile re-encrypts file content with destination keys
+// and returns its new ref.
+func (c *copier) copyFile(ref *block.Ref, src, dst *config.Settings) (*block.Ref, error) {
+	if newRef, ok := c.files[*ref]; ok {
+		return newRef, nil
+	}
+	src.Use()
+	r, err := block.NewReader(ref)
+	if err != nil {
+		return nil, err
+	}
+	dst.Use()
+	w := block.NewWriter()
+	buf := make([]byte, src.BlockSize)
+	for {
+		src.Use()
+		n, err := r.Read(buf)
+		if n > 0 {
+			dst.Use()
+			if _, err := w.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	dst.Use()
+	newRef, err := w.Finish()
+	if err != nil {
+		return nil, err
+	}
+	c.files[*ref] = newRef
+	return newRef, nil
+}
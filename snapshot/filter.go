@@ -0,0 +1,61 @@
+package snapshot
+
+// Filter selects snapshots by their information.
+// Empty fields match any snapshot.
+type Filter struct {
+	Hosts []string // host name is any of these
+	Users []string // user name is any of these
+	Paths []string // source path is any of these
+	Tags  []string // snapshot has all of these tags
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if snapshot info matches filter.
+func (f *Filter) Match(info *Info) bool {
+	if len(f.Hosts) > 0 && !containsString(f.Hosts, info.Hostname) {
+		return false
+	}
+	if len(f.Users) > 0 && !containsString(f.Users, info.Username) {
+		return false
+	}
+	if len(f.Paths) > 0 && !containsString(f.Paths, info.SourcePath) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !info.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsEmpty returns true if filter matches any snapshot.
+func (f *Filter) IsEmpty() bool {
+	return len(f.Hosts) == 0 && len(f.Users) == 0 && len(f.Paths) == 0 && len(f.Tags) == 0
+}
+
+// FilterNames returns names of snapshots that match filter.
+func FilterNames(names []string, f *Filter) ([]string, error) {
+	if f.IsEmpty() {
+		return names, nil
+	}
+	filtered := make([]string, 0, len(names))
+	for _, name := range names {
+		info, err := LoadInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		if f.Match(info) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered, nil
+}
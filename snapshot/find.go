@@ -0,0 +1,153 @@
+package snapshot
+
+import (
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/dir"
+)
+
+// Query describes files to find.
+type Query struct {
+	Glob    string         // shell pattern to match file name, if not empty
+	Regexp  *regexp.Regexp // regular expression to match file name, if not nil
+	MinSize int64          // minimum size
+	MaxSize int64          // maximum size, if not negative
+	Newer   time.Time      // files modified after this time, if not zero
+	Older   time.Time      // files modified before this time, if not zero
+	Type    string         // "f" for files, "d" for directories, or empty for any
+}
+
+// Match returns true if entry matches query.
+//
+// Only the entry itself, not its path, is matched, so that results for
+// a directory don't depend on where it is located.
+func (q *Query) Match(e *dir.Entry) bool {
+	switch q.Type {
+	case "f":
+		if e.Mode.IsDir() {
+			return false
+		}
+	case "d":
+		if !e.Mode.IsDir() {
+			return false
+		}
+	}
+	if e.Size < q.MinSize || (q.MaxSize >= 0 && e.Size > q.MaxSize) {
+		return false
+	}
+	if !q.Newer.IsZero() && !e.ModTime.After(q.Newer) {
+		return false
+	}
+	if !q.Older.IsZero() && !e.ModTime.Before(q.Older) {
+		return false
+	}
+	if q.Glob != "" {
+		if ok, _ := path.Match(q.Glob, e.Name); !ok {
+			return false
+		}
+	}
+	if q.Regexp != nil && !q.Regexp.MatchString(e.Name) {
+		return false
+	}
+	return true
+}
+
+// Found is a file found by Find.
+type Found struct {
+	Path  string // slash-separated path inside snapshot
+	Entry *dir.Entry
+}
+
+// finder finds files, remembering results for each visited directory,
+// so that directories shared by many snapshots are searched only once.
+//
+// Only entries of the directory itself are remembered, not paths of all
+// files found under it, so that memory used doesn't grow with depth.
+type finder struct {
+	q     *Query
+	found map[block.Ref][]foundItem
+}
+
+// foundItem is an entry of directory, which either matches query
+// or is a subdirectory containing matching entries.
+type foundItem struct {
+	entry  *dir.Entry
+	match  bool // entry matches query
+	hasSub bool // entry is a directory containing matching entries
+}
+
+// search searches directory with the given ref and its subdirectories
+// and returns entries of directory leading to matching files.
+func (f *finder) search(ref *block.Ref) ([]foundItem, error) {
+	if items, ok := f.found[*ref]; ok {
+		return items, nil
+	}
+	entries, err := dir.LoadDirectory(ref)
+	if err != nil {
+		return nil, err
+	}
+	var items []foundItem
+	for _, e := range entries {
+		it := foundItem{entry: e, match: f.q.Match(e)}
+		if e.Mode.IsDir() {
+			sub, err := f.search(e.Ref)
+			if err != nil {
+				return nil, err
+			}
+			it.hasSub = len(sub) > 0
+		}
+		if it.match || it.hasSub {
+			items = append(items, it)
+		}
+	}
+	f.found[*ref] = items
+	return items, nil
+}
+
+// walk calls fn for each file found in directory with the
+// given ref, which was searched before, prefixing paths with base.
+func (f *finder) walk(ref *block.Ref, base string, fn func(found *Found) error) error {
+	for _, it := range f.found[*ref] {
+		p := path.Join(base, it.entry.Name)
+		if it.match {
+			if err := fn(&Found{p, it.entry}); err != nil {
+				return err
+			}
+		}
+		if it.hasSub {
+			if err := f.walk(it.entry.Ref, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Find searches selected snapshots for files matching query
+// and calls fn for each found file.
+func Find(sels []*Selection, q *Query, fn func(sel *Selection, found *Found) error) error {
+	f := &finder{q: q, found: make(map[block.Ref][]foundItem)}
+	for _, sel := range sels {
+		if !sel.Entry.Mode.IsDir() {
+			if q.Match(sel.Entry) {
+				if err := fn(sel, &Found{sel.Path, sel.Entry}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if _, err := f.search(sel.Entry.Ref); err != nil {
+			return err
+		}
+		err := f.walk(sel.Entry.Ref, sel.Path, func(found *Found) error {
+			return fn(sel, found)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Policy describes which snapshots to keep when forgetting snapshots.
+type Policy struct {
+	Last    int           // keep n last snapshots
+	Hourly  int           // keep the last snapshot for each of n last hours
+	Daily   int           // keep the last snapshot for each of n last days
+	Weekly  int           // keep the last snapshot for each of n last weeks
+	Monthly int           // keep the last snapshot for each of n last months
+	Yearly  int           // keep the last snapshot for each of n last years
+	Within  time.Duration // keep snapshots made within this duration
+	Tags    []string      // keep snapshots with any of these tags
+}
+
+// IsEmpty returns true if policy doesn't keep any snapshots.
+func (p *Policy) IsEmpty() bool {
+	return p.Last == 0 && p.Hourly == 0 && p.Daily == 0 && p.Weekly == 0 &&
+		p.Monthly == 0 && p.Yearly == 0 && p.Within == 0 && len(p.Tags) == 0
+}
+
+// Decision describes whether to keep a snapshot and why.
+type Decision struct {
+	Name    string
+	Info    *Info
+	Keep    bool
+	Reasons []string
+}
+
+// bucket keeps the last snapshot in each of n periods.
+type bucket struct {
+	n      int
+	reason string
+	key    func(t time.Time) string
+	last   string
+}
+
+func (b *bucket) keep(t time.Time) bool {
+	if b.n <= 0 {
+		return false
+	}
+	k := b.key(t)
+	if k == b.last {
+		return false
+	}
+	b.last = k
+	b.n--
+	return true
+}
+
+func weekKey(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-%02d", year, week)
+}
+
+func formatKey(layout string) func(t time.Time) string {
+	return func(t time.Time) string {
+		return t.Format(layout)
+	}
+}
+
+func groupKey(info *Info) string {
+	return info.SourcePath + "\x00" + info.Hostname
+}
+
+// decide returns decisions for snapshots of a single group,
+// which must be sorted from newest to oldest.
+func decide(group []*Decision, policy *Policy, now time.Time) {
+	buckets := []*bucket{
+		{n: policy.Hourly, reason: "hourly", key: formatKey("2006-01-02 15")},
+		{n: policy.Daily, reason: "daily", key: formatKey("2006-01-02")},
+		{n: policy.Weekly, reason: "weekly", key: weekKey},
+		{n: policy.Monthly, reason: "monthly", key: formatKey("2006-01")},
+		{n: policy.Yearly, reason: "yearly", key: formatKey("2006")},
+	}
+	for i, d := range group {
+		t := d.Info.Time.Local()
+		if i < policy.Last {
+			d.Reasons = append(d.Reasons, "last")
+		}
+		for _, b := range buckets {
+			if b.keep(t) {
+				d.Reasons = append(d.Reasons, b.reason)
+			}
+		}
+		if policy.Within > 0 && now.Sub(t) < policy.Within {
+			d.Reasons = append(d.Reasons, "within "+policy.Within.String())
+		}
+		for _, tag := range policy.Tags {
+			if d.Info.HasTag(tag) {
+				d.Reasons = append(d.Reasons, "tagged "+tag)
+			}
+		}
+		d.Keep = len(d.Reasons) > 0
+	}
+}
+
+// ApplyPolicy decides which of the given snapshots to keep according to
+// policy. Snapshots are grouped by source path and host name, and policy
+// is applied to each group separately. Decisions are returned ordered by
+// group and then from newest to oldest snapshot.
+func ApplyPolicy(names []string, policy *Policy, now time.Time) ([]*Decision, error) {
+	if policy.IsEmpty() {
+		return nil, errors.New("empty policy would remove all snapshots")
+	}
+	decisions := make([]*Decision, 0, len(names))
+	for _, name := range names {
+		info, err := LoadInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, &Decision{Name: name, Info: info})
+	}
+	return applyPolicy(decisions, policy, now), nil
+}
+
+// applyPolicy groups decisions, decides them, and returns them
+// in the order described in ApplyPolicy.
+func applyPolicy(all []*Decision, policy *Policy, now time.Time) []*Decision {
+	groups := make(map[string][]*Decision)
+	keys := make([]string, 0)
+	for _, d := range all {
+		k := groupKey(d.Info)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], d)
+	}
+	sort.Strings(keys)
+	decisions := make([]*Decision, 0, len(all))
+	for _, k := range keys {
+		group := groups[k]
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Info.Time.After(group[j].Info.Time)
+		})
+		decide(group, policy, now)
+		decisions = append(decisions, group...)
+	}
+	return decisions
+}
+
+// Forget applies policy to the given snapshots and removes snapshots that
+// are not kept. It returns decisions and names of all remaining snapshots,
+// which should be passed to CollectGarbage to remove blocks used only by
+// removed snapshots. If dryRun is true, nothing is removed.
+func Forget(names []string, policy *Policy, dryRun bool) (decisions []*Decision, namesToLeave []string, err error) {
+	decisions, err = ApplyPolicy(names, policy, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	removed := make(map[string]bool)
+	for _, d := range decisions {
+		if d.Keep {
+			continue
+		}
+		removed[d.Name] = true
+		if !dryRun {
+			log.Printf("removing snapshot %s", d.Name)
+			if err := Remove(d.Name); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	// Keep blocks of all remaining snapshots,
+	// including those that were not considered.
+	allNames, err := GetNames()
+	if err != nil {
+		return nil, nil, err
+	}
+	namesToLeave = make([]string, 0, len(allNames))
+	for _, name := range allNames {
+		if !removed[name] {
+			namesToLeave = append(namesToLeave, name)
+		}
+	}
+	return decisions, namesToLeave, nil
+}
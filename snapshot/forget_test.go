@@ -0,0 +1,196 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSnapshot struct {
+	name   string
+	time   string // RFC 3339
+	source string // default "/src"
+	host   string // default "host"
+	tags   []string
+}
+
+// decisions returns decisions for snapshots with their infos.
+func decisions(t *testing.T, snapshots []testSnapshot) []*Decision {
+	var list []*Decision
+	for _, s := range snapshots {
+		tm, err := time.Parse(time.RFC3339, s.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &Info{Time: tm, SourcePath: "/src", Hostname: "host", Tags: s.tags}
+		if s.source != "" {
+			info.SourcePath = s.source
+		}
+		if s.host != "" {
+			info.Hostname = s.host
+		}
+		list = append(list, &Decision{Name: s.name, Info: info})
+	}
+	return list
+}
+
+// formatDecisions returns decisions as "name: reasons" lines,
+// with reasons of removed snapshots being "-".
+func formatDecisions(list []*Decision) string {
+	lines := make([]string, len(list))
+	for i, d := range list {
+		reasons := "-"
+		if d.Keep {
+			reasons = strings.Join(d.Reasons, ", ")
+		}
+		lines[i] = d.Name + ": " + reasons
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestApplyPolicy(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		zone      *time.Location // local time zone, default UTC
+		policy    Policy
+		snapshots []testSnapshot
+		want      []string
+	}{
+		{
+			name:   "last",
+			policy: Policy{Last: 2},
+			snapshots: []testSnapshot{
+				{name: "c", time: "2021-06-13T10:00:00Z"},
+				{name: "a", time: "2021-06-15T10:00:00Z"},
+				{name: "d", time: "2021-06-12T10:00:00Z"},
+				{name: "b", time: "2021-06-14T10:00:00Z"},
+			},
+			want: []string{"a: last", "b: last", "c: -", "d: -"},
+		},
+		{
+			name:   "hourly",
+			policy: Policy{Hourly: 2},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-06-15T10:50:00Z"},
+				{name: "b", time: "2021-06-15T10:10:00Z"},
+				{name: "c", time: "2021-06-15T09:30:00Z"},
+				{name: "d", time: "2021-06-15T08:00:00Z"},
+			},
+			want: []string{"a: hourly", "b: -", "c: hourly", "d: -"},
+		},
+		{
+			name:   "daily across month",
+			policy: Policy{Daily: 3},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-03-01T01:00:00Z"},
+				{name: "b", time: "2021-02-28T23:00:00Z"},
+				{name: "c", time: "2021-02-28T10:00:00Z"},
+				{name: "d", time: "2021-02-27T05:00:00Z"},
+				{name: "e", time: "2021-02-26T05:00:00Z"},
+			},
+			want: []string{"a: daily", "b: daily", "c: -", "d: daily", "e: -"},
+		},
+		{
+			// 2021-01-03 is in ISO week 53 of 2020,
+			// which starts on Monday 2020-12-28.
+			name:   "weekly across year",
+			policy: Policy{Weekly: 3},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-01-04T10:00:00Z"},
+				{name: "b", time: "2021-01-03T10:00:00Z"},
+				{name: "c", time: "2020-12-28T10:00:00Z"},
+				{name: "d", time: "2020-12-27T10:00:00Z"},
+				{name: "e", time: "2020-12-20T10:00:00Z"},
+			},
+			want: []string{"a: weekly", "b: weekly", "c: -", "d: weekly", "e: -"},
+		},
+		{
+			name:   "monthly and yearly",
+			policy: Policy{Monthly: 2, Yearly: 3},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-01-15T10:00:00Z"},
+				{name: "b", time: "2020-12-31T23:00:00Z"},
+				{name: "c", time: "2020-12-01T10:00:00Z"},
+				{name: "d", time: "2019-06-01T10:00:00Z"},
+				{name: "e", time: "2018-01-01T10:00:00Z"},
+			},
+			want: []string{"a: monthly, yearly", "b: monthly, yearly", "c: -", "d: yearly", "e: -"},
+		},
+		{
+			name:   "last and daily",
+			policy: Policy{Last: 1, Daily: 2},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-06-15T10:00:00Z"},
+				{name: "b", time: "2021-06-15T09:00:00Z"},
+				{name: "c", time: "2021-06-14T08:00:00Z"},
+				{name: "d", time: "2021-06-13T08:00:00Z"},
+			},
+			want: []string{"a: last, daily", "b: -", "c: daily", "d: -"},
+		},
+		{
+			name:   "within",
+			policy: Policy{Within: 48 * time.Hour},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-06-15T10:00:00Z"},
+				{name: "b", time: "2021-06-13T13:00:00Z"},
+				{name: "c", time: "2021-06-13T11:00:00Z"},
+			},
+			want: []string{"a: within 48h0m0s", "b: within 48h0m0s", "c: -"},
+		},
+		{
+			name:   "tags",
+			policy: Policy{Last: 1, Tags: []string{"keep", "monthly"}},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-06-15T10:00:00Z", tags: []string{"other"}},
+				{name: "b", time: "2021-06-14T10:00:00Z", tags: []string{"keep"}},
+				{name: "c", time: "2021-06-13T10:00:00Z", tags: []string{"other"}},
+				{name: "d", time: "2021-06-12T10:00:00Z", tags: []string{"monthly", "keep"}},
+			},
+			want: []string{"a: last", "b: tagged keep", "c: -", "d: tagged keep, tagged monthly"},
+		},
+		{
+			// Days are in local time: a and b are on different days
+			// in UTC+10, but on the same day in UTC.
+			name:   "local time",
+			zone:   time.FixedZone("UTC+10", 10*60*60),
+			policy: Policy{Daily: 2},
+			snapshots: []testSnapshot{
+				{name: "a", time: "2021-06-14T15:00:00Z"},
+				{name: "b", time: "2021-06-14T13:00:00Z"},
+				{name: "c", time: "2021-06-14T10:00:00Z"},
+			},
+			want: []string{"a: daily", "b: daily", "c: -"},
+		},
+		{
+			name:   "groups",
+			policy: Policy{Last: 1},
+			snapshots: []testSnapshot{
+				{name: "b1", time: "2021-06-15T10:00:00Z", source: "/b", host: "h1"},
+				{name: "a2-old", time: "2021-06-13T10:00:00Z", source: "/a", host: "h2"},
+				{name: "a1", time: "2021-06-14T10:00:00Z", source: "/a", host: "h1"},
+				{name: "a1-old", time: "2021-06-12T11:00:00Z", source: "/a", host: "h1"},
+				{name: "a2", time: "2021-06-14T10:00:00Z", source: "/a", host: "h2"},
+			},
+			want: []string{"a1: last", "a1-old: -", "a2: last", "a2-old: -", "b1: last"},
+		},
+	}
+	for _, tt := range tests {
+		time.Local = time.UTC
+		if tt.zone != nil {
+			time.Local = tt.zone
+		}
+		got := formatDecisions(applyPolicy(decisions(t, tt.snapshots), &tt.policy, now))
+		if want := strings.Join(tt.want, "\n"); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
+
+func TestApplyEmptyPolicy(t *testing.T) {
+	if _, err := ApplyPolicy([]string{"a"}, &Policy{}, time.Now()); err == nil {
+		t.Fatal("expected error for empty policy")
+	}
+}
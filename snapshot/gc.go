@@ -5,33 +5,75 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/dchest/hesfic/block"
 	"github.com/dchest/hesfic/config"
 	"github.com/dchest/hesfic/dir"
+	"github.com/dchest/hesfic/progress"
+	"github.com/dchest/hesfic/safefile"
 )
 
-func CollectGarbage(namesToLeave []string, dryRun bool) error {
+// Temporary files older than this are considered left after a crash.
+const staleTempAge = 24 * time.Hour
+
+// Garbage describes an unused block, parity group or temporary file
+// found by garbage collection.
+type Garbage struct {
+	Kind   string // "block", "parity group" or "temporary file"
+	Name   string // block ref, parity group id or file path
+	Size   int64  `json:",omitempty"` // size of block or file on disk
+	Used   int    `json:",omitempty"` // number of used blocks in parity group
+	Blocks int    `json:",omitempty"` // number of all blocks in parity group
+}
+
+func (g *Garbage) String() string {
+	switch g.Kind {
+	case GarbageBlock:
+		return "unused block " + g.Name
+	case GarbageParity:
+		return fmt.Sprintf("unused parity group %s (%d of %d blocks used)", g.Name, g.Used, g.Blocks)
+	}
+	return g.Kind + " " + g.Name
+}
+
+// Kinds of garbage.
+const (
+	GarbageBlock  = "block"
+	GarbageParity = "parity group"
+	GarbageTemp   = "temporary file"
+)
+
+// CollectGarbage removes blocks, parity groups and stale temporary files
+// which are not used by snapshots with the given names, and returns what
+// was removed. If dryRun is true, it returns what would be removed without
+// removing anything.
+func CollectGarbage(namesToLeave []string, dryRun bool) ([]*Garbage, error) {
 	if len(namesToLeave) == 0 {
-		return nil
+		return nil, nil
 	}
+	var garbage []*Garbage
 	usedRefs := make(map[block.Ref]int)
 	for _, name := range namesToLeave {
 		info, err := LoadInfo(name)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Walk and mark used refs.
-		usedRefs[*info.DirRef]++
+		mark := func(ref *block.Ref) error {
+			usedRefs[*ref]++
+			return nil
+		}
+		if err := block.WalkRefs(info.DirRef, mark); err != nil {
+			return nil, err
+		}
 		err = dir.Walk(info.DirRef, func(path string, file *dir.Entry) error {
-			return block.WalkRefs(file.Ref, func(ref *block.Ref) error {
-				usedRefs[*ref]++
-				return nil
-			})
+			progress.AddFile()
+			return block.WalkRefs(file.Ref, mark)
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -43,24 +85,41 @@ func CollectGarbage(namesToLeave []string, dryRun bool) error {
 			}
 			return nil
 		}
+		if safefile.IsTemp(fi.Name()) && time.Since(fi.ModTime()) > staleTempAge {
+			// Left after a crash.
+			garbage = append(garbage, &Garbage{Kind: GarbageTemp, Name: path, Size: fi.Size()})
+			if !dryRun {
+				log.Printf("removing temporary file %s", path)
+				return os.Remove(path)
+			}
+			return nil
+		}
 		ref := block.RefFromHex([]byte(filepath.Base(filepath.Dir(path)) + fi.Name()))
 		if ref == nil {
 			return nil // not a block, skip
 		}
+		progress.AddBytes(fi.Size())
 		if n, ok := usedRefs[*ref]; ok || n > 0 {
 			return nil // block is used
 		}
+		garbage = append(garbage, &Garbage{Kind: GarbageBlock, Name: ref.String(), Size: fi.Size()})
 		if !dryRun {
 			// Block unused, remove it.
 			log.Printf("removing unused block %s", ref)
 			return os.Remove(path)
-		} else {
-			fmt.Printf("unused block %s\n", ref)
 		}
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = block.PruneParity(func(ref *block.Ref) bool {
+		return usedRefs[*ref] > 0
+	}, dryRun, func(id string, used, total int) {
+		garbage = append(garbage, &Garbage{Kind: GarbageParity, Name: id, Used: used, Blocks: total})
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return garbage, nil
 }
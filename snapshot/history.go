@@ -0,0 +1,101 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/dir"
+)
+
+// Version is a distinct version of file found in snapshots.
+type Version struct {
+	Entry *dir.Entry // entry from the first snapshot with this version
+	Path  string     // path of file inside the last snapshot
+	First *Info      // the first snapshot with this version
+	Last  *Info      // the last snapshot with this version
+	Count int        // number of snapshots with this version
+
+	FirstName string // name of the first snapshot
+	LastName  string // name of the last snapshot
+}
+
+// relPath returns path inside snapshot for the given absolute path
+// of file on disk, if snapshot contains it.
+func (info *Info) relPath(abspath string) (string, bool) {
+	within := func(dirpath string) (string, bool) {
+		rel, err := filepath.Rel(dirpath, abspath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", false
+		}
+		return filepath.ToSlash(rel), true
+	}
+	if len(info.Sources) == 0 {
+		return within(info.SourcePath)
+	}
+	for _, s := range info.Sources {
+		if rel, ok := within(s); ok {
+			if rel == "." {
+				return filepath.Base(s), true
+			}
+			return filepath.Base(s) + "/" + rel, true
+		}
+	}
+	return "", false
+}
+
+// History returns distinct versions of file at the given path in
+// snapshots matching filter, ordered by the time they first appeared.
+// Versions are distinguished by content ref. The path is either
+// relative to snapshot root or an absolute path of file on disk, in which
+// case only snapshots of source paths containing it are searched. Relative
+// path requires filter to select source path, so that unrelated files with
+// the same path in snapshots of different sources are not mixed.
+func History(path string, filter *Filter) ([]*Version, error) {
+	if !filepath.IsAbs(path) && len(filter.Paths) == 0 {
+		return nil, fmt.Errorf("relative path %s requires selecting snapshots by source path", path)
+	}
+	names, err := GetNames()
+	if err != nil {
+		return nil, err
+	}
+	names, err = FilterNames(names, filter)
+	if err != nil {
+		return nil, err
+	}
+	var versions []*Version
+	byRef := make(map[block.Ref]*Version)
+	for _, name := range names {
+		info, err := LoadInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		p := strings.Trim(filepath.ToSlash(path), "/")
+		if filepath.IsAbs(path) {
+			var ok bool
+			if p, ok = info.relPath(path); !ok {
+				continue
+			}
+		}
+		e, err := dir.Lookup(info.DirRef, p)
+		if err != nil {
+			log.Printf("%s:%s: %s", name, p, err)
+			continue
+		}
+		if e.Mode.IsDir() {
+			continue
+		}
+		v := byRef[*e.Ref]
+		if v == nil {
+			v = &Version{Entry: e, Path: p, First: info, FirstName: name}
+			byRef[*e.Ref] = v
+			versions = append(versions, v)
+		}
+		v.Last, v.LastName = info, name
+		v.Path = p
+		v.Count++
+	}
+	return versions, nil
+}
@@ -0,0 +1,297 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/hesfic/dir"
+)
+
+// Selection is a snapshot or a part of it selected by expression.
+type Selection struct {
+	Name  string     // snapshot name
+	Info  *Info      // snapshot information
+	Path  string     // path inside snapshot, empty for root directory
+	Entry *dir.Entry // entry at path
+}
+
+// splitExpr splits selection expression into snapshot selector
+// and path inside snapshot.
+func splitExpr(expr string) (selector, path string) {
+	prefixLen := 0
+	switch {
+	case strings.HasPrefix(expr, "@{"):
+		if i := strings.Index(expr, "}"); i >= 0 {
+			prefixLen = i + 1
+		}
+	case strings.HasPrefix(expr, "latest:/"):
+		prefixLen = len("latest:")
+		if i := strings.Index(expr[prefixLen:], ":"); i >= 0 {
+			prefixLen += i
+		} else {
+			prefixLen = len(expr)
+		}
+	case strings.HasPrefix(expr, "tag:"):
+		prefixLen = len("tag:")
+	}
+	if i := strings.Index(expr[prefixLen:], ":"); i >= 0 {
+		return expr[:prefixLen+i], strings.Trim(expr[prefixLen+i+1:], "/")
+	}
+	return expr, ""
+}
+
+var timeUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// ParseTime parses time given as date ("2006-01-02"), date and time
+// ("2006-01-02 15:04" or "2006-01-02 15:04:05"), RFC 3339, "now",
+// "yesterday", or relative time, such as "3 days ago". Dates without
+// time mean the end of day.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "now":
+		return now, nil
+	case "yesterday":
+		return now.Add(-24 * time.Hour), nil
+	}
+	if f := strings.Fields(s); len(f) == 3 && f[2] == "ago" {
+		n, err := strconv.Atoi(f[0])
+		if err == nil {
+			if unit, ok := timeUnits[strings.TrimSuffix(f[1], "s")]; ok {
+				return now.Add(-time.Duration(n) * unit), nil
+			}
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time %q", s)
+}
+
+func isDate(s string) bool {
+	_, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	return err == nil
+}
+
+func sameDay(t0, t1 time.Time) bool {
+	y0, m0, d0 := t0.Local().Date()
+	y1, m1, d1 := t1.Local().Date()
+	return y0 == y1 && m0 == m1 && d0 == d1
+}
+
+// selectNames returns names of snapshots matching the given selector,
+// ordered from oldest to newest, and whether selector is a name prefix.
+func selectNames(selector string, filter *Filter) (names []string, isPrefix bool, err error) {
+	all, err := GetNames()
+	if err != nil {
+		return nil, false, err
+	}
+	candidates, err := FilterNames(all, filter)
+	if err != nil {
+		return nil, false, err
+	}
+	if IsValidName(selector) {
+		for _, name := range candidates {
+			if name == selector {
+				return []string{name}, false, nil
+			}
+		}
+		return nil, false, fmt.Errorf("snapshot %s not found", selector)
+	}
+	// Returns candidates that satisfy fn.
+	matching := func(fn func(info *Info) bool) ([]string, error) {
+		var names []string
+		for _, name := range candidates {
+			info, err := LoadInfo(name)
+			if err != nil {
+				return nil, err
+			}
+			if fn(info) {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	switch {
+	case selector == "latest":
+		if len(candidates) > 0 {
+			names = candidates[len(candidates)-1:]
+		}
+	case strings.HasPrefix(selector, "latest:"):
+		sourcePath := selector[len("latest:"):]
+		names, err = matching(func(info *Info) bool {
+			return info.SourcePath == sourcePath
+		})
+		if len(names) > 0 {
+			names = names[len(names)-1:]
+		}
+	case strings.HasPrefix(selector, "tag:"):
+		tag := selector[len("tag:"):]
+		names, err = matching(func(info *Info) bool {
+			return info.HasTag(tag)
+		})
+	case strings.HasPrefix(selector, "@{") && strings.HasSuffix(selector, "}"):
+		var t time.Time
+		t, err = ParseTime(selector[2:len(selector)-1], time.Now())
+		if err != nil {
+			return nil, false, err
+		}
+		names, err = matching(func(info *Info) bool {
+			return !info.Time.After(t)
+		})
+		if len(names) > 0 {
+			names = names[len(names)-1:]
+		}
+	case isDate(selector):
+		t, _ := time.ParseInLocation("2006-01-02", selector, time.Local)
+		names, err = matching(func(info *Info) bool {
+			return sameDay(info.Time, t)
+		})
+	case selector == "":
+		names = candidates
+	default:
+		// Name prefix.
+		isPrefix = true
+		for _, name := range candidates {
+			if strings.HasPrefix(name, selector) {
+				names = append(names, name)
+			}
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(names) == 0 && selector != "" {
+		return nil, false, fmt.Errorf("no snapshots match %q", selector)
+	}
+	return names, isPrefix, nil
+}
+
+func newSelection(name, path string) (*Selection, error) {
+	info, err := LoadInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	var entry *dir.Entry
+	if path == "" {
+		entry = &dir.Entry{
+			Name:    "",
+			ModTime: info.Time,
+			Mode:    os.ModeDir | 0755,
+			Ref:     info.DirRef,
+		}
+	} else {
+		entry, err = dir.Lookup(info.DirRef, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %s", name, path, err)
+		}
+	}
+	return &Selection{
+		Name:  name,
+		Info:  info,
+		Path:  path,
+		Entry: entry,
+	}, nil
+}
+
+// Select returns all snapshots selected by expression expr among those
+// matching filter, ordered from oldest to newest. Empty expression
+// selects all snapshots.
+//
+// Expression consists of selector optionally followed by colon and path
+// inside snapshot. Selector can be:
+//
+//	full snapshot name or its unique prefix
+//	"latest"                 the latest snapshot
+//	"latest:/source/path"    the latest snapshot of the source path
+//	"tag:foo"                snapshots tagged with foo
+//	"2006-01-02"             snapshots made on the given day
+//	"@{time}"                the latest snapshot made before the given time,
+//	                         e.g. "@{3 days ago}" or "@{2006-01-02 15:04}"
+//
+// For example, "latest:docs/letter.txt" selects file docs/letter.txt
+// in the latest snapshot.
+func Select(expr string, filter *Filter) ([]*Selection, error) {
+	selector, path := splitExpr(expr)
+	names, _, err := selectNames(selector, filter)
+	if err != nil {
+		return nil, err
+	}
+	sels := make([]*Selection, len(names))
+	for i, name := range names {
+		sels[i], err = newSelection(name, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sels, nil
+}
+
+// SelectOne returns a single snapshot selected by expression expr
+// (see Select). If expression selects multiple snapshots, the newest
+// is returned, unless expression is an ambiguous name prefix.
+func SelectOne(expr string, filter *Filter) (*Selection, error) {
+	selector, path := splitExpr(expr)
+	names, isPrefix, err := selectNames(selector, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no snapshots")
+	}
+	if isPrefix && len(names) > 1 {
+		return nil, fmt.Errorf("snapshot prefix %q is ambiguous", selector)
+	}
+	return newSelection(names[len(names)-1], path)
+}
+
+// Totals returns the number of files in selection and their total size.
+// It uses statistics recorded in snapshot information if the whole
+// snapshot is selected, otherwise it walks the selected directory.
+// Files that cannot be read are not counted. Walking stops early
+// when cancel is closed.
+func (sel *Selection) Totals(cancel <-chan struct{}) (files, bytes int64) {
+	if sel.Path == "" && sel.Info.FileCount > 0 {
+		return sel.Info.FileCount, sel.Info.TotalBytes
+	}
+	if !sel.Entry.Mode.IsDir() {
+		return 1, sel.Entry.Size
+	}
+	dir.Walk(sel.Entry.Ref, func(path string, e *dir.Entry) error {
+		select {
+		case <-cancel:
+			return errTotalsCancelled
+		default:
+		}
+		if !e.Mode.IsDir() {
+			files++
+			if !e.IsSymlink() {
+				bytes += e.Size
+			}
+		}
+		return nil
+	})
+	return
+}
+
+var errTotalsCancelled = errors.New("totals cancelled")
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/user"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -20,6 +21,7 @@ import (
 	"github.com/dchest/hesfic/block"
 	"github.com/dchest/hesfic/config"
 	"github.com/dchest/hesfic/dir"
+	"github.com/dchest/hesfic/safefile"
 )
 
 func IsValidName(name string) bool {
@@ -55,31 +57,61 @@ type Info struct {
 	Time       time.Time
 	Comment    string `json:",omitempty"`
 	SourcePath string
+	Sources    []string `json:",omitempty"` // source paths of root entries, if root is synthetic
+	Hostname   string   `json:",omitempty"`
+	Username   string   `json:",omitempty"`
+	Tags       []string `json:",omitempty"`
+	Version    string   `json:",omitempty"` // version of hesfic which created snapshot
 	DirRef     *block.Ref
+
+	// Statistics.
+	FileCount  int64 `json:",omitempty"` // number of files
+	TotalBytes int64 `json:",omitempty"` // total size of files
+	NewBytes   int64 `json:",omitempty"` // size of blocks added by snapshot
+
+	// Files which were skipped because they couldn't be read.
+	Skipped []*dir.Skipped `json:",omitempty"`
+	// Paths of files which were changing while being read,
+	// so their stored content may be inconsistent.
+	Changed []string `json:",omitempty"`
+}
+
+// HasTag returns true if snapshot is tagged with the given tag.
+func (info *Info) HasTag(tag string) bool {
+	return containsString(info.Tags, tag)
 }
 
 func (info *Info) store() (name string, err error) {
+	// Nonce is big endian 8-byte UnixNano timestamp || 16 random bytes.
+	var nonce [24]byte
+
+	binary.BigEndian.PutUint64(nonce[:8], uint64(time.Now().UnixNano()))
+	if _, err = io.ReadFull(rand.Reader, nonce[8:]); err != nil {
+		return
+	}
+	name = nonceToName(&nonce)
+	err = info.storeAs(name)
+	return
+}
+
+// storeAs stores snapshot info under the given name.
+func (info *Info) storeAs(name string) error {
 	// Marshal.
 	data, err := json.Marshal(info)
 	if err != nil {
-		return
+		return err
 	}
 
 	// Encrypt.
-	// Nonce is big endian 8-byte UnixNano timestamp || 16 random bytes.
 	var nonce [24]byte
-
-	binary.BigEndian.PutUint64(nonce[:8], uint64(time.Now().UnixNano()))
-	if _, err = io.ReadFull(rand.Reader, nonce[8:]); err != nil {
-		return
+	if err := nameToNonce(&nonce, name); err != nil {
+		return err
 	}
 	encryptedData := secretbox.Seal(nil, data, &nonce, &config.Keys.SnapshotEnc)
 
 	// Store.
-	name = nonceToName(&nonce)
 	path := filepath.Join(config.SnapshotsPath, name)
-	err = ioutil.WriteFile(path, encryptedData, 0666)
-	return
+	return safefile.WriteFile(path, encryptedData, 0644)
 }
 
 func LoadInfo(name string) (info *Info, err error) {
@@ -107,52 +139,163 @@ func LoadInfo(name string) (info *Info, err error) {
 	return
 }
 
-func Create(dirpath string, comment string) error {
-	file, err := dir.SaveDirectory(dirpath)
+// Create creates a snapshot of files and directories at the given paths
+// and returns its name. If a single directory is given, it becomes the
+// root of snapshot; otherwise, the root is a synthetic directory
+// containing all given paths, which must have different base names.
+//
+// Comment, Tags, Hostname, Username and Version are taken from the given
+// info; if Hostname or Username are empty, they are set to the current ones.
+//
+// Files inside directories that cannot be read are handled according to
+// config.OnError; skipped files are recorded in snapshot's Skipped.
+func Create(paths []string, info *Info) (name string, err error) {
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no paths given")
+	}
+	var stats dir.Stats
+	abspaths := make([]string, len(paths))
+	for i, p := range paths {
+		abspaths[i], err = filepath.Abs(p)
+		if err != nil {
+			abspaths[i] = p
+		}
+	}
+	var dirRef *block.Ref
+	var sources []string
+	if fi, err := os.Stat(paths[0]); err == nil && fi.IsDir() && len(paths) == 1 {
+		file, err := dir.SaveDirectory(paths[0], &stats)
+		if err != nil {
+			return "", err
+		}
+		dirRef = file.Ref
+	} else {
+		entries := make([]*dir.Entry, 0, len(paths))
+		seen := make(map[string]bool)
+		for i, p := range paths {
+			e, err := dir.SavePath(p, &stats)
+			if err != nil {
+				return "", err
+			}
+			if seen[e.Name] {
+				return "", fmt.Errorf("more than one source path named %s", e.Name)
+			}
+			seen[e.Name] = true
+			entries = append(entries, e)
+			sources = append(sources, abspaths[i])
+		}
+		dirRef, err = saveRoot(entries, &stats)
+		if err != nil {
+			return "", err
+		}
+	}
+	si := *info
+	si.SourcePath = strings.Join(abspaths, ", ")
+	si.Sources = sources
+	return finishCreate(&si, dirRef, &stats)
+}
+
+// CreateFromReader creates a snapshot containing a single file with the
+// given name, which content is read from r, and returns snapshot name.
+// Snapshot's source path is "-".
+func CreateFromReader(r io.Reader, filename string, info *Info) (name string, err error) {
+	var stats dir.Stats
+	e, err := dir.SaveReader(filename, r, &stats)
 	if err != nil {
-		return err
+		return "", err
 	}
-	abspath, err := filepath.Abs(dirpath)
+	dirRef, err := saveRoot([]*dir.Entry{e}, &stats)
 	if err != nil {
-		abspath = dirpath
+		return "", err
 	}
-	info := &Info{
-		Time:       time.Now(),
-		Comment:    comment,
-		SourcePath: abspath,
-		DirRef:     file.Ref,
+	si := *info
+	si.SourcePath = "-"
+	return finishCreate(&si, dirRef, &stats)
+}
+
+// Import creates a snapshot of files from tar archive read from r and
+// returns its name. Snapshot's source path is set to the given one.
+func Import(r io.Reader, sourcePath string, info *Info) (name string, err error) {
+	var stats dir.Stats
+	dirRef, err := dir.ImportTar(r, &stats)
+	if err != nil {
+		return "", err
 	}
-	name, err := info.store()
+	si := *info
+	si.SourcePath = sourcePath
+	return finishCreate(&si, dirRef, &stats)
+}
+
+// Export writes selected snapshot or its part to w as a tar archive.
+func Export(w io.Writer, sel *Selection) error {
+	return dir.ExportTar(w, sel.Entry)
+}
+
+// saveRoot stores synthetic root directory with the given entries.
+func saveRoot(entries []*dir.Entry, stats *dir.Stats) (*block.Ref, error) {
+	ref, newBytes, err := dir.SaveEntries(entries)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Printf("stored snapshot %s", name)
-	return nil
+	stats.NewBytes += newBytes
+	return ref, nil
 }
 
-func Restore(outdir string, name string) error {
-	info, err := LoadInfo(name)
+// finishCreate fills the rest of snapshot info and stores it.
+func finishCreate(si *Info, dirRef *block.Ref, stats *dir.Stats) (name string, err error) {
+	if err := block.FlushParity(); err != nil {
+		return "", err
+	}
+	si.Time = time.Now()
+	si.DirRef = dirRef
+	si.FileCount = stats.Files
+	si.TotalBytes = stats.Bytes
+	si.NewBytes = stats.NewBytes
+	si.Skipped = stats.Skipped
+	si.Changed = stats.Changed
+	if si.Hostname == "" {
+		si.Hostname, _ = os.Hostname()
+	}
+	if si.Username == "" {
+		if u, err := user.Current(); err == nil {
+			si.Username = u.Username
+		}
+	}
+	name, err = si.store()
 	if err != nil {
-		return err
+		return "", err
 	}
-	log.Printf("restoring snapshot %s to %s:", info.DirRef, outdir)
-	if err := dir.RestoreDirectory(info.DirRef, outdir); err != nil {
+	log.Printf("stored snapshot %s", name)
+	return name, nil
+}
+
+// Restore restores selected snapshot or its part into outdir
+// using the given number of concurrent workers.
+func Restore(outdir string, sel *Selection, workers int) error {
+	log.Printf("restoring snapshot %s:%s to %s:", sel.Name, sel.Path, outdir)
+	if err := dir.RestoreEntry(sel.Entry, outdir, workers); err != nil {
 		return err
 	}
 	return nil
 }
 
-func Verify(name string) error {
-	info, err := LoadInfo(name)
-	if err != nil {
-		return err
-	}
-	if err := dir.VerifyDirectory(info.DirRef); err != nil {
+// Verify verifies selected snapshot or its part.
+func Verify(sel *Selection) error {
+	if err := dir.VerifyEntry(sel.Entry); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Remove removes snapshot with the given name. Blocks used by it
+// are not removed: use CollectGarbage for that.
+func Remove(name string) error {
+	if !IsValidName(name) {
+		return fmt.Errorf("invalid snapshot name %s", name)
+	}
+	return os.Remove(filepath.Join(config.SnapshotsPath, name))
+}
+
 func GetNames() (names []string, err error) {
 	names = make([]string, 0)
 	err = filepath.Walk(config.SnapshotsPath, func(path string, fi os.FileInfo, err error) error {
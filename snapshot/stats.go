@@ -0,0 +1,137 @@
+package snapshot
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/dir"
+)
+
+// SnapshotStats contains statistics about a snapshot.
+type SnapshotStats struct {
+	Name           string
+	Time           time.Time
+	SourcePath     string
+	Files          int64 // number of files
+	LogicalBytes   int64 // total size of files
+	ExclusiveBytes int64 // size of blocks used only by this snapshot
+}
+
+// Stats contains statistics about repository.
+type Stats struct {
+	Snapshots        int
+	LogicalBytes     int64   // total size of files in all snapshots
+	Blocks           int     // number of unique blocks used by snapshots
+	DataBytes        int64   // size of uncompressed data in blocks
+	CompressedBytes  int64   // size of compressed data in blocks
+	StoredBytes      int64   // size of used blocks on disk, excluding orphan blocks
+	PaddingBytes     int64   // size of padding in blocks on disk
+	DedupRatio       float64 // LogicalBytes / DataBytes
+	CompressionRatio float64 // DataBytes / CompressedBytes
+
+	SnapshotStats []*SnapshotStats
+}
+
+// statsCache holds statistics for the set of snapshots they were last
+// calculated for. Since snapshots and blocks they use never change,
+// statistics only need to be calculated again when snapshots are added
+// or removed.
+var statsCache struct {
+	sync.Mutex
+	key   string // blocks path and snapshot names
+	stats *Stats
+}
+
+// GetStats reads all snapshots and blocks they use and returns statistics
+// about repository. Blocks not used by any snapshot are not counted.
+// Statistics are cached until the list of snapshots changes, and the
+// returned value must not be modified.
+func GetStats() (*Stats, error) {
+	names, err := GetNames()
+	if err != nil {
+		return nil, err
+	}
+	key := config.BlocksPath + "\n" + strings.Join(names, "\n")
+	statsCache.Lock()
+	defer statsCache.Unlock()
+	if statsCache.stats != nil && statsCache.key == key {
+		return statsCache.stats, nil
+	}
+	st, err := getStats(names)
+	if err != nil {
+		return nil, err
+	}
+	statsCache.key = key
+	statsCache.stats = st
+	return st, nil
+}
+
+func getStats(names []string) (*Stats, error) {
+	st := &Stats{Snapshots: len(names)}
+	// Index of the only snapshot using block, or -1 if it's used by many.
+	owners := make(map[block.Ref]int)
+	for i, name := range names {
+		info, err := LoadInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		ss := &SnapshotStats{
+			Name:       name,
+			Time:       info.Time,
+			SourcePath: info.SourcePath,
+		}
+		seen := make(map[block.Ref]bool)
+		mark := func(ref *block.Ref) error {
+			if seen[*ref] {
+				return nil
+			}
+			seen[*ref] = true
+			if owner, ok := owners[*ref]; !ok {
+				owners[*ref] = i
+			} else if owner != i {
+				owners[*ref] = -1
+			}
+			return nil
+		}
+		if err := block.WalkRefs(info.DirRef, mark); err != nil {
+			return nil, err
+		}
+		err = dir.Walk(info.DirRef, func(path string, e *dir.Entry) error {
+			if !e.Mode.IsDir() {
+				ss.Files++
+				ss.LogicalBytes += e.Size
+			}
+			return block.WalkRefs(e.Ref, mark)
+		})
+		if err != nil {
+			return nil, err
+		}
+		st.LogicalBytes += ss.LogicalBytes
+		st.SnapshotStats = append(st.SnapshotStats, ss)
+	}
+	for ref, owner := range owners {
+		r := ref
+		bi, err := block.Stat(&r)
+		if err != nil {
+			return nil, err
+		}
+		st.Blocks++
+		st.DataBytes += int64(bi.Size)
+		st.CompressedBytes += int64(bi.CompressedSize)
+		st.StoredBytes += int64(bi.StoredSize)
+		st.PaddingBytes += int64(bi.PaddingSize())
+		if owner >= 0 {
+			st.SnapshotStats[owner].ExclusiveBytes += int64(bi.StoredSize)
+		}
+	}
+	if st.DataBytes > 0 {
+		st.DedupRatio = float64(st.LogicalBytes) / float64(st.DataBytes)
+	}
+	if st.CompressedBytes > 0 {
+		st.CompressionRatio = float64(st.DataBytes) / float64(st.CompressedBytes)
+	}
+	return st, nil
+}
@@ -0,0 +1,40 @@
+package snapshot
+
+import (
+	"os"
+	"testing"
+
+	"github.com/dchest/hesfic/config"
+	"github.com/dchest/hesfic/internal/testrepo"
+)
+
+func TestStatsCache(t *testing.T) {
+	defer testrepo.Use(t)()
+	createTestSnapshot(t)
+	st, err := GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Snapshots != 1 || st.SnapshotStats[0].Files != 1 ||
+		st.SnapshotStats[0].LogicalBytes != int64(10*config.BlockSize) {
+		t.Fatalf("bad stats: %+v", st)
+	}
+
+	// Stats are not calculated again while snapshots don't change:
+	// with blocks removed, they can't be.
+	if err := os.RemoveAll(config.BlocksPath); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != st {
+		t.Fatalf("stats weren't cached")
+	}
+	config.MakePaths()
+	createTestSnapshot(t)
+	if _, err := GetStats(); err == nil {
+		t.Fatalf("cached stats returned after adding snapshot")
+	}
+}
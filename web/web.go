@@ -2,33 +2,63 @@ package web
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/dchest/hesfic/block"
+	"github.com/dchest/hesfic/daemon"
 	"github.com/dchest/hesfic/dir"
+	"github.com/dchest/hesfic/lock"
 	"github.com/dchest/hesfic/snapshot"
 )
 
 var (
-	indexTemplate = template.Must(template.New("index").Parse(indexTemplateSrc))
-	dirTemplate   = template.Must(template.New("dir").Parse(dirTemplateSrc))
-	fileTemplate  = template.Must(template.New("file").Parse(fileTemplateSrc))
+	indexTemplate   = template.Must(template.New("index").Parse(indexTemplateSrc))
+	dirTemplate     = template.Must(template.New("dir").Parse(dirTemplateSrc))
+	fileTemplate    = template.Must(template.New("file").Parse(fileTemplateSrc))
+	historyTemplate = template.Must(template.New("history").Parse(historyTemplateSrc))
+	statsTemplate   = template.Must(template.New("stats").Parse(statsTemplateSrc))
+	daemonTemplate  = template.Must(template.New("daemon").Parse(daemonTemplateSrc))
 )
 
+// DaemonStatus, if not nil, returns status of scheduled backup jobs,
+// which is shown on Backups page and served as JSON at /daemon.json.
+var DaemonStatus func() []*daemon.Status
+
 type snapshotDesc struct {
 	Name       string
 	Time       string
 	SourcePath string
+	Hostname   string
+	Username   string
+	Tags       []string
+	Files      string
+	Size       string
+	Added      string
 	DirRef     string
 	DirRefPart string
 	Comment    string
 }
 
+// requestFilter returns snapshot filter from request query.
+func requestFilter(req *http.Request) *snapshot.Filter {
+	q := req.URL.Query()
+	return &snapshot.Filter{
+		Hosts: q["host"],
+		Users: q["user"],
+		Paths: q["path"],
+		Tags:  q["tag"],
+	}
+}
+
 func indexHandler(w http.ResponseWriter, req *http.Request) {
 	// List snapshots.
 	names, err := snapshot.GetNames()
@@ -36,8 +66,9 @@ func indexHandler(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	rows := make([]snapshotDesc, len(names))
-	for i, name := range names {
+	filter := requestFilter(req)
+	rows := make([]snapshotDesc, 0, len(names))
+	for _, name := range names {
 		var r snapshotDesc
 		r.Name = name
 		si, err := snapshot.LoadInfo(name)
@@ -45,12 +76,27 @@ func indexHandler(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !filter.Match(si) {
+			continue
+		}
 		r.Comment = si.Comment
 		r.SourcePath = si.SourcePath
+		r.Hostname = si.Hostname
+		r.Username = si.Username
+		r.Tags = si.Tags
+		if si.FileCount > 0 {
+			r.Files = fmt.Sprintf("%d", si.FileCount)
+			r.Size = sizeString(si.TotalBytes)
+			r.Added = sizeString(si.NewBytes)
+		}
 		r.Time = si.Time.Local().Format("02 Jan 2006 15:04:05 Mon")
 		r.DirRef = si.DirRef.String()
 		r.DirRefPart = r.DirRef[:12] + "…"
-		rows[len(rows)-1-i] = r // in reverse
+		rows = append(rows, r)
+	}
+	// Newest first.
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
 	}
 
 	var b bytes.Buffer
@@ -69,12 +115,14 @@ func indexHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 type fileDesc struct {
-	IsDir bool
-	Name  string
-	Mode  string
-	Time  string
-	Size  string
-	Ref   string
+	IsDir       bool
+	Link        string
+	HistoryLink string
+	Name        string
+	Mode        string
+	Time        string
+	Size        string
+	Ref         string
 }
 
 type fileDescSlice []fileDesc
@@ -116,14 +164,29 @@ func sizeString(n int64) string {
 	return fmt.Sprintf("%6d", n)
 }
 
-func dirHandler(w http.ResponseWriter, req *http.Request) {
-	refName := path.Base(req.URL.Path)
-	//TODO reject other paths.
-	dirRef := block.RefFromHex([]byte(refName))
-	if dirRef == nil {
-		http.Error(w, fmt.Sprintf("Bad ref"), http.StatusBadRequest)
-		return
+// escapePath escapes each segment of slash-separated path.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
 	}
+	return strings.Join(segments, "/")
+}
+
+// withQuery returns link with query of request appended,
+// so that snapshot filter is kept when following it.
+func withQuery(link string, req *http.Request) string {
+	if req.URL.RawQuery == "" {
+		return link
+	}
+	return link + "?" + req.URL.RawQuery
+}
+
+// writeDirectory writes listing of directory with the given ref.
+// If dirExpr, which is snapshot expression selecting the directory ending
+// with slash, is not empty, links to files and subdirectories are formed
+// by appending their names to it, otherwise they point to their refs.
+func writeDirectory(w http.ResponseWriter, req *http.Request, title string, dirRef *block.Ref, dirExpr string) {
 	files, err := dir.LoadDirectory(dirRef)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -138,6 +201,17 @@ func dirHandler(w http.ResponseWriter, req *http.Request) {
 		r.Time = f.ModTime.Local().Format("02 Jan 2006 15:04")
 		r.Size = sizeString(f.Size)
 		r.Ref = f.Ref.String()
+		switch {
+		case !r.IsDir:
+			r.Link = "/file/" + r.Ref
+			if dirExpr != "" {
+				r.HistoryLink = withQuery("/history/"+escapePath(dirExpr+f.Name), req)
+			}
+		case dirExpr != "":
+			r.Link = withQuery("/snapshot/"+escapePath(dirExpr+f.Name), req)
+		default:
+			r.Link = "/dir/" + r.Ref
+		}
 		rows[i] = r
 	}
 	sort.Sort(fileDescSlice(rows))
@@ -148,7 +222,7 @@ func dirHandler(w http.ResponseWriter, req *http.Request) {
 			DirRef *block.Ref
 			Files  []fileDesc
 		}{
-			"Directory",
+			title,
 			dirRef,
 			rows,
 		}); err != nil {
@@ -158,6 +232,230 @@ func dirHandler(w http.ResponseWriter, req *http.Request) {
 	b.WriteTo(w)
 }
 
+func dirHandler(w http.ResponseWriter, req *http.Request) {
+	refName := path.Base(req.URL.Path)
+	//TODO reject other paths.
+	dirRef := block.RefFromHex([]byte(refName))
+	if dirRef == nil {
+		http.Error(w, fmt.Sprintf("Bad ref"), http.StatusBadRequest)
+		return
+	}
+	writeDirectory(w, req, "Directory", dirRef, "")
+}
+
+// snapshotHandler shows directory selected by snapshot expression,
+// e.g. /snapshot/latest:docs or /snapshot/tag:daily.
+func snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	expr := strings.TrimPrefix(req.URL.Path, "/snapshot/")
+	sel, err := snapshot.SelectOne(expr, requestFilter(req))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !sel.Entry.Mode.IsDir() {
+		http.Redirect(w, req, "/file/"+sel.Entry.Ref.String(), http.StatusFound)
+		return
+	}
+	dirPath := sel.Path
+	if dirPath != "" {
+		dirPath += "/"
+	}
+	writeDirectory(w, req, sel.Name+":/"+sel.Path, sel.Entry.Ref, sel.Name+":"+dirPath)
+}
+
+type versionDesc struct {
+	Link      string
+	Time      string
+	Size      string
+	FirstTime string
+	LastTime  string
+	Count     int
+	Ref       string
+}
+
+// historyHandler shows versions of file selected by snapshot expression
+// in all snapshots with the same source path, e.g. /history/latest:docs/a.txt.
+func historyHandler(w http.ResponseWriter, req *http.Request) {
+	expr := strings.TrimPrefix(req.URL.Path, "/history/")
+	filter := requestFilter(req)
+	sel, err := snapshot.SelectOne(expr, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	filter.Paths = []string{sel.Info.SourcePath}
+	versions, err := snapshot.History(sel.Path, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	const timeFormat = "02 Jan 2006 15:04"
+	rows := make([]versionDesc, len(versions))
+	for i, v := range versions {
+		rows[len(rows)-1-i] = versionDesc{
+			Link:      withQuery("/snapshot/"+escapePath(v.LastName+":"+v.Path), req),
+			Time:      v.Entry.ModTime.Local().Format(timeFormat),
+			Size:      sizeString(v.Entry.Size),
+			FirstTime: v.First.Time.Local().Format(timeFormat),
+			LastTime:  v.Last.Time.Local().Format(timeFormat),
+			Count:     v.Count,
+			Ref:       v.Entry.Ref.String(),
+		}
+	}
+	var b bytes.Buffer
+	if err := historyTemplate.Execute(&b,
+		&struct {
+			Title    string
+			Versions []versionDesc
+		}{
+			"History of " + sel.Info.SourcePath + ":/" + sel.Path,
+			rows,
+		}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b.WriteTo(w)
+}
+
+type snapshotStatsDesc struct {
+	Name       string
+	Time       string
+	SourcePath string
+	Files      int64
+	Size       string
+	Exclusive  string
+}
+
+func statsHandler(w http.ResponseWriter, req *http.Request) {
+	// Blocks must not be removed by gc while they are read.
+	l, err := lock.Acquire(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	st, err := snapshot.GetStats()
+	l.Release()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows := make([]snapshotStatsDesc, len(st.SnapshotStats))
+	for i, ss := range st.SnapshotStats {
+		// Newest first.
+		rows[len(rows)-1-i] = snapshotStatsDesc{
+			Name:       ss.Name,
+			Time:       ss.Time.Local().Format("02 Jan 2006 15:04:05 Mon"),
+			SourcePath: ss.SourcePath,
+			Files:      ss.Files,
+			Size:       sizeString(ss.LogicalBytes),
+			Exclusive:  sizeString(ss.ExclusiveBytes),
+		}
+	}
+	var b bytes.Buffer
+	if err := statsTemplate.Execute(&b,
+		&struct {
+			Title       string
+			Stats       *snapshot.Stats
+			LogicalSize string
+			DataSize    string
+			StoredSize  string
+			PaddingSize string
+			Snapshots   []snapshotStatsDesc
+		}{
+			"Statistics",
+			st,
+			sizeString(st.LogicalBytes),
+			sizeString(st.DataBytes),
+			sizeString(st.StoredBytes),
+			sizeString(st.PaddingBytes),
+			rows,
+		}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b.WriteTo(w)
+}
+
+type jobDesc struct {
+	Profile  string
+	Schedule string
+	State    string
+	Failed   bool
+	LastRun  string
+	Duration string
+	LastOK   string
+	NextRun  string
+	Failures int
+	Error    string
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("02 Jan 2006 15:04:05 Mon")
+}
+
+func daemonHandler(w http.ResponseWriter, req *http.Request) {
+	var list []*daemon.Status
+	if DaemonStatus != nil {
+		list = DaemonStatus()
+	}
+	if req.URL.Path == "/daemon.json" {
+		if list == nil {
+			http.Error(w, "not running as daemon", http.StatusNotFound)
+			return
+		}
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	jobs := make([]jobDesc, len(list))
+	for i, st := range list {
+		jd := jobDesc{
+			Profile:  st.Profile,
+			Schedule: st.Schedule,
+			State:    st.Result,
+			Failed:   st.Result == daemon.ResultFailed,
+			LastRun:  formatTime(st.LastStart),
+			LastOK:   formatTime(st.LastOK),
+			NextRun:  formatTime(st.NextRun),
+			Failures: st.Failures,
+			Error:    st.Error,
+		}
+		if !st.LastEnd.IsZero() && !st.LastEnd.Before(st.LastStart) {
+			jd.Duration = st.LastEnd.Sub(st.LastStart).Truncate(time.Second).String()
+		}
+		switch {
+		case st.Running:
+			jd.State = "running"
+		case st.Retry:
+			jd.NextRun += " (retry)"
+		}
+		jobs[i] = jd
+	}
+	var b bytes.Buffer
+	if err := daemonTemplate.Execute(&b,
+		&struct {
+			Title   string
+			Running bool
+			Jobs    []jobDesc
+		}{
+			"Backups",
+			DaemonStatus != nil,
+			jobs,
+		}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b.WriteTo(w)
+}
+
 func fileHandler(w http.ResponseWriter, req *http.Request) {
 	//XXX Not implemented.
 	var b bytes.Buffer
@@ -180,6 +478,11 @@ func Serve(addr string) error {
 	}
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/dir/", dirHandler)
+	http.HandleFunc("/snapshot/", snapshotHandler)
+	http.HandleFunc("/history/", historyHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/daemon", daemonHandler)
+	http.HandleFunc("/daemon.json", daemonHandler)
 	http.HandleFunc("/file/", fileHandler)
 	fmt.Printf("Listening %s...\n", ln.Addr())
 	return http.Serve(ln, nil)
@@ -201,6 +504,8 @@ const commonHeader = `
       <a class="brand" href="/">Hesfic</a>
       <ul class="nav">
       <li><a href="/">Snapshots</a></li>
+      <li><a href="/stats">Statistics</a></li>
+      <li><a href="/daemon">Backups</a></li>
       </ul>
     </div>
   </div>
@@ -220,39 +525,134 @@ const indexTemplateSrc = commonHeader + `
  <tr>
   <th>Date</th>
   <th>Source Path</th>
+  <th>Host</th>
+  <th>User</th>
+  <th>Files</th>
+  <th>Size</th>
+  <th>Added</th>
   <th>Ref</th>
+  <th>Tags</th>
   <th>Comment</th>
  </tr>
  {{range .Snapshots}}
  <tr>
-  <td><a href="dir/{{.DirRef}}" title="Snapshot {{.Name}}">{{.Time}}</a></td>
-  <td>{{.SourcePath}}</td>
+  <td><a href="/snapshot/{{.Name}}" title="Snapshot {{.Name}}">{{.Time}}</a></td>
+  <td><a href="/?path={{.SourcePath}}">{{.SourcePath}}</a></td>
+  <td><a href="/?host={{.Hostname}}">{{.Hostname}}</a></td>
+  <td>{{.Username}}</td>
+  <td>{{.Files}}</td>
+  <td>{{.Size}}</td>
+  <td>{{.Added}}</td>
   <td><small style="font: 10px monospace" title="{{.DirRef}}">{{.DirRefPart}}</small></td>
+  <td>{{range .Tags}}<a class="label" href="/?tag={{.}}">{{.}}</a> {{end}}</td>
   <td>{{.Comment}}</td>
  </tr>
  {{end}}` + commonFooter
 
 const dirTemplateSrc = commonHeader + `
-<h4><a class="btn btn-small" href="javascript:history.back()"><i class="icon-chevron-left"></i></a> &nbsp; Directory <span class="muted">{{.DirRef}}</span></h4>
+<h4><a class="btn btn-small" href="javascript:history.back()"><i class="icon-chevron-left"></i></a> &nbsp; {{.Title}} <span class="muted">{{.DirRef}}</span></h4>
 <table class="table table-bordered">
  <tr>
   <th>Name</th>
   <th>Date Modified</th>
   <th>Size</th>
   <th>Perm.</th>
+  <th></th>
  </tr>
  {{range .Files}}
  <tr>
   {{if .IsDir}}
-  <td><a href="../dir/{{.Ref}}"><i class="icon-folder-close"></i> <b>{{.Name}}</b></a></td>
+  <td><a href="{{.Link}}"><i class="icon-folder-close"></i> <b>{{.Name}}</b></a></td>
   {{else}}
-  <td><a href="../file/{{.Ref}}"><i class="icon-file"></i> {{.Name}}</a></td>
+  <td><a href="{{.Link}}"><i class="icon-file"></i> {{.Name}}</a></td>
   {{end}}
   <td>{{.Time}}</td>
   <td>{{.Size}}</td>
   <td>{{.Mode}}</td>
+  <td>{{if .HistoryLink}}<a href="{{.HistoryLink}}" title="Versions of this file in other snapshots">History</a>{{end}}</td>
  </tr>
  {{end}}` + commonFooter
 
+const historyTemplateSrc = commonHeader + `
+<h4><a class="btn btn-small" href="javascript:history.back()"><i class="icon-chevron-left"></i></a> &nbsp; {{.Title}}</h4>
+<table class="table table-bordered">
+ <tr>
+  <th>Date Modified</th>
+  <th>Size</th>
+  <th>First Seen</th>
+  <th>Last Seen</th>
+  <th>Snapshots</th>
+  <th>Ref</th>
+ </tr>
+ {{range .Versions}}
+ <tr>
+  <td><a href="{{.Link}}"><i class="icon-file"></i> {{.Time}}</a></td>
+  <td>{{.Size}}</td>
+  <td>{{.FirstTime}}</td>
+  <td>{{.LastTime}}</td>
+  <td>{{.Count}}</td>
+  <td><small style="font: 10px monospace">{{.Ref}}</small></td>
+ </tr>
+ {{end}}` + commonFooter
+
+const statsTemplateSrc = commonHeader + `
+<h4>{{.Title}}</h4>
+<table class="table table-bordered">
+ <tr><th>Snapshots</th><td>{{.Stats.Snapshots}}</td></tr>
+ <tr><th>Logical size</th><td>{{.LogicalSize}}</td></tr>
+ <tr><th>Unique blocks</th><td>{{.Stats.Blocks}}</td></tr>
+ <tr><th>Data size</th><td>{{.DataSize}}</td></tr>
+ <tr><th>Stored size</th><td>{{.StoredSize}} <small>(used blocks only)</small></td></tr>
+ <tr><th>Padding</th><td>{{.PaddingSize}}</td></tr>
+ <tr><th>Dedup ratio</th><td>{{printf "%.2f" .Stats.DedupRatio}}</td></tr>
+ <tr><th>Compression ratio</th><td>{{printf "%.2f" .Stats.CompressionRatio}}</td></tr>
+</table>
+<table class="table table-striped table-bordered">
+ <tr>
+  <th>Date</th>
+  <th>Source Path</th>
+  <th>Files</th>
+  <th>Size</th>
+  <th>Exclusive</th>
+ </tr>
+ {{range .Snapshots}}
+ <tr>
+  <td><a href="/snapshot/{{.Name}}" title="Snapshot {{.Name}}">{{.Time}}</a></td>
+  <td>{{.SourcePath}}</td>
+  <td>{{.Files}}</td>
+  <td>{{.Size}}</td>
+  <td>{{.Exclusive}}</td>
+ </tr>
+ {{end}}` + commonFooter
+
+const daemonTemplateSrc = commonHeader + `
+<h4>{{.Title}}</h4>
+{{if not .Running}}
+<p>Scheduled backups are not running. Start web server with "hesfic daemon" to see them here.</p>
+<table>
+{{else}}
+<table class="table table-striped table-bordered">
+ <tr>
+  <th>Profile</th>
+  <th>Schedule</th>
+  <th>Result</th>
+  <th>Last Run</th>
+  <th>Duration</th>
+  <th>Last Success</th>
+  <th>Next Run</th>
+ </tr>
+ {{range .Jobs}}
+ <tr{{if .Failed}} class="error"{{end}}>
+  <td>{{.Profile}}</td>
+  <td><code>{{.Schedule}}</code></td>
+  <td>{{.State}}{{if .Failures}} ({{.Failures}} failures){{end}}{{if .Error}}<br><small>{{.Error}}</small>{{end}}</td>
+  <td>{{.LastRun}}</td>
+  <td>{{.Duration}}</td>
+  <td>{{.LastOK}}</td>
+  <td>{{.NextRun}}</td>
+ </tr>
+ {{end}}
+{{end}}` + commonFooter
+
 const fileTemplateSrc = commonHeader +
 	`<h4>Not implemented.</h4>` + commonFooter